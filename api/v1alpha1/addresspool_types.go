@@ -35,19 +35,135 @@ type AddressPoolSpec struct {
 	// start-end range of IPs.
 	Addresses []string `json:"addresses"`
 
+	// ReserveAddresses lists addresses of the pool MetalLB must not allocate,
+	// e.g. its gateway. They are left out of the addresses of the pool in the
+	// MetalLB config.
+	// +optional
+	ReserveAddresses []string `json:"reserveAddresses,omitempty" yaml:"-"`
+
 	// AutoAssign flag used to prevent MetallB from automatic allocation
 	// for a pool.
 	// +optional
 	// +kubebuilder:default:=true
 	AutoAssign *bool `json:"auto-assign,omitempty" yaml:"auto-assign,omitempty"`
+
+	// MaxAllocations is the number of addresses of the pool the LoadBalancer
+	// services are expected to use at most. MetalLB doesn't enforce it, a
+	// warning is reported when the limit is reached.
+	// +kubebuilder:validation:Minimum:=0
+	// +optional
+	MaxAllocations *int `json:"maxAllocations,omitempty" yaml:"-"`
+
+	// Overlays override the settings of the pool in the MetalLB config
+	// for the environment selected by the Metallb resource.
+	// +optional
+	Overlays []AddressPoolOverlay `json:"overlays,omitempty" yaml:"-"`
+}
+
+// AddressPoolOverlay holds the settings of an AddressPool overriding
+// the base ones in a given environment
+type AddressPoolOverlay struct {
+	// Environment is the environment of the Metallb resource
+	// the overlay applies to
+	Environment string `json:"environment"`
+
+	// Addresses replace the addresses of the pool when set
+	// +optional
+	Addresses []string `json:"addresses,omitempty"`
+
+	// AutoAssign replaces the auto-assign flag of the pool when set
+	// +optional
+	AutoAssign *bool `json:"auto-assign,omitempty"`
+}
+
+// OverlaidSpec returns the spec of the pool with the overlay of the
+// environment applied, if any
+func (p *AddressPool) OverlaidSpec(environment string) *AddressPoolSpec {
+	spec := p.Spec.DeepCopy()
+	if environment == "" {
+		return spec
+	}
+	for _, overlay := range spec.Overlays {
+		if overlay.Environment != environment {
+			continue
+		}
+		if len(overlay.Addresses) > 0 {
+			spec.Addresses = overlay.Addresses
+		}
+		if overlay.AutoAssign != nil {
+			spec.AutoAssign = overlay.AutoAssign
+		}
+	}
+	return spec
 }
 
 // AddressPoolStatus defines the observed state of AddressPool
 type AddressPoolStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// AllocatedAddresses is the number of addresses of the pool
+	// currently assigned to LoadBalancer services
+	// +optional
+	AllocatedAddresses int `json:"allocatedAddresses,omitempty"`
+
+	// ConfigReload tells whether MetalLB hot reloaded the last change of the
+	// pool in its config, or if the speakers must be restarted to apply it
+	// +optional
+	ConfigReload string `json:"configReload,omitempty"`
+
+	// Conditions show the issues detected on the pool
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
+const (
+	// ConditionCapacityExceeded is set when more LoadBalancer services
+	// request an address from the pool than it holds
+	ConditionCapacityExceeded = "CapacityExceeded"
+
+	// ConditionUnused is set when the pool is excluded from the automatic
+	// assignment and no LoadBalancer service draws an address from it
+	ConditionUnused = "Unused"
+
+	// ConditionMissingIPFamily is set when dual-stack LoadBalancer services
+	// request an address from a pool holding a single IP family
+	ConditionMissingIPFamily = "MissingIPFamily"
+
+	// ConditionOutsideNodeSubnets is set when addresses of a layer2 pool
+	// are outside of the subnets the nodes are attached to, or is unknown
+	// when no node lists its subnets in the metallb.io/node-subnets annotation
+	ConditionOutsideNodeSubnets = "OutsideNodeSubnets"
+
+	// ConditionSharingConflict is set when LoadBalancer services request an
+	// address from a pool excluded from the automatic assignment, while
+	// sharing it with services requesting another pool
+	ConditionSharingConflict = "SharingConflict"
+
+	// ConditionAllocationLimitReached is set when the LoadBalancer services
+	// use as many addresses of the pool as its maxAllocations, or more
+	ConditionAllocationLimitReached = "AllocationLimitReached"
+)
+
+const (
+	// ConfigReloadHot is set when MetalLB applies the change of the pool
+	// without disruption
+	ConfigReloadHot = "HotReload"
+
+	// ConfigReloadRestart is set when the change of the pool is only
+	// applied once the speakers are restarted
+	ConfigReloadRestart = "RestartRequired"
+)
+
+// SkipLabel excludes an AddressPool from the generated MetalLB config
+// when set to "true", without deleting it
+const SkipLabel = "metallb.io/skip"
+
+// SharedAddressesAnnotation allows the addresses of an AddressPool to overlap
+// with the ones of other pools carrying the annotation set to "true", for
+// setups sharing IPs on purpose
+const SharedAddressesAnnotation = "metallb.io/shared-addresses"
+
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 
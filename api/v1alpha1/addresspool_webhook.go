@@ -0,0 +1,200 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	"github.com/metallb/metallb-operator/pkg/pool"
+)
+
+// log is for logging in this package.
+var addresspoollog = logf.Log.WithName("addresspool-resource")
+
+// serviceReader is used by the webhook to list the services of all the namespaces
+var serviceReader client.Reader
+
+// poolReader is used by the webhook to list the existing AddressPools
+// and to get the Metallb resource
+var poolReader client.Reader
+
+// metallbName is the name of the Metallb resource selecting the environment
+// of the pools of its namespace
+const metallbName = "metallb"
+
+// SetupWebhookWithManager registers the AddressPool validating webhook.
+// services must be able to list the services of all the namespaces.
+func (r *AddressPool) SetupWebhookWithManager(mgr ctrl.Manager, services client.Reader) error {
+	serviceReader = services
+	poolReader = mgr.GetClient()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-metallb-io-v1alpha1-addresspool,mutating=false,failurePolicy=fail,groups=metallb.io,resources=addresspools,versions=v1alpha1,name=vaddresspool.kb.io
+
+var _ webhook.Validator = &AddressPool{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *AddressPool) ValidateCreate() error {
+	addresspoollog.Info("validate create", "name", r.Name)
+
+	pools := &AddressPoolList{}
+	if err := poolReader.List(context.Background(), pools, client.InNamespace(r.Namespace)); err != nil {
+		return fmt.Errorf("failed to list addresspools: %v", err)
+	}
+	if err := validateOverlaps(r, pools.Items); err != nil {
+		return err
+	}
+	return validateReservations(r)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *AddressPool) ValidateUpdate(old runtime.Object) error {
+	addresspoollog.Info("validate update", "name", r.Name)
+
+	oldPool, ok := old.(*AddressPool)
+	if !ok {
+		return fmt.Errorf("unexpected object %T, expected an AddressPool", old)
+	}
+
+	pools := &AddressPoolList{}
+	if err := poolReader.List(context.Background(), pools, client.InNamespace(r.Namespace)); err != nil {
+		return fmt.Errorf("failed to list addresspools: %v", err)
+	}
+	if err := validateOverlaps(r, pools.Items); err != nil {
+		return err
+	}
+	if err := validateReservations(r); err != nil {
+		return err
+	}
+
+	metallb := &Metallb{}
+	err := poolReader.Get(context.Background(), types.NamespacedName{Name: metallbName, Namespace: r.Namespace}, metallb)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get the metallb resource: %v", err)
+	}
+
+	services := &corev1.ServiceList{}
+	if err := serviceReader.List(context.Background(), services); err != nil {
+		return fmt.Errorf("failed to list services: %v", err)
+	}
+	return validateAllocationsKept(oldPool, r, metallb.Spec.Environment, services.Items)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *AddressPool) ValidateDelete() error {
+	return nil
+}
+
+// validateAllocationsKept rejects changes of the pool addresses which would
+// leave out an address currently assigned to a LoadBalancer service. The
+// addresses are compared as in the config, with the overlay of the environment
+// applied and the reserved addresses left out.
+func validateAllocationsKept(oldPool, newPool *AddressPool, environment string, services []corev1.Service) error {
+	oldRanges, err := configRanges(oldPool, environment)
+	if err != nil {
+		// Nothing can be allocated from an invalid pool
+		return nil
+	}
+	newRanges, err := configRanges(newPool, environment)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range pool.Allocations(oldRanges, services) {
+		if !pool.ContainsIP(newRanges, a.IP) {
+			return fmt.Errorf("address %s assigned to service %s is not part of the addresses of pool %s anymore",
+				a.IP, a.Service, newPool.Spec.Name)
+		}
+	}
+	return nil
+}
+
+// configRanges returns the ranges of the pool in the config of the
+// environment, without the reserved addresses
+func configRanges(p *AddressPool, environment string) ([]pool.IPRange, error) {
+	spec := p.OverlaidSpec(environment)
+	addresses, err := pool.ExcludeAddresses(spec.Addresses, spec.ReserveAddresses)
+	if err != nil {
+		return nil, err
+	}
+	return pool.ParseRanges(addresses)
+}
+
+// validateOverlaps rejects pools whose addresses overlap with the ones of
+// another pool, unless both pools are explicitly flagged as sharing addresses
+func validateOverlaps(newPool *AddressPool, pools []AddressPool) error {
+	newRanges, err := pool.ParseRanges(newPool.Spec.Addresses)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pools {
+		if p.Namespace == newPool.Namespace && p.Name == newPool.Name {
+			continue
+		}
+		if isShared(newPool) && isShared(&p) {
+			continue
+		}
+		ranges, err := pool.ParseRanges(p.Spec.Addresses)
+		if err != nil {
+			continue
+		}
+		for _, r := range newRanges {
+			for _, other := range ranges {
+				if r.Overlaps(other) {
+					return fmt.Errorf("addresses of pool %s overlap with the ones of pool %s, set the %s annotation on both pools if the addresses are shared on purpose",
+						newPool.Spec.Name, p.Spec.Name, SharedAddressesAnnotation)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateReservations rejects reserved addresses not belonging to the pool,
+// in any of its environments
+func validateReservations(p *AddressPool) error {
+	if _, err := pool.ExcludeAddresses(p.Spec.Addresses, p.Spec.ReserveAddresses); err != nil {
+		return fmt.Errorf("invalid reserved addresses of pool %s: %v", p.Spec.Name, err)
+	}
+	for _, overlay := range p.Spec.Overlays {
+		if len(overlay.Addresses) == 0 {
+			continue
+		}
+		if _, err := pool.ExcludeAddresses(overlay.Addresses, p.Spec.ReserveAddresses); err != nil {
+			return fmt.Errorf("invalid reserved addresses of pool %s in environment %s: %v", p.Spec.Name, overlay.Environment, err)
+		}
+	}
+	return nil
+}
+
+func isShared(p *AddressPool) bool {
+	return p.Annotations[SharedAddressesAnnotation] == "true"
+}
@@ -0,0 +1,155 @@
+package v1alpha1
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateAllocationsKept(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	oldPool := &AddressPool{
+		Spec: AddressPoolSpec{
+			Name:      "gold",
+			Protocol:  "layer2",
+			Addresses: []string{"172.20.0.0/24"},
+		},
+	}
+	service := corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: "172.20.0.200"}},
+			},
+		},
+	}
+
+	newPool := oldPool.DeepCopy()
+	newPool.Spec.Addresses = []string{"172.20.0.0-172.20.0.100"}
+	err := validateAllocationsKept(oldPool, newPool, "", []corev1.Service{service})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("default/web"))
+	g.Expect(err.Error()).To(ContainSubstring("172.20.0.200"))
+
+	newPool.Spec.Addresses = []string{"172.20.0.0-172.20.0.100", "172.20.0.200/32"}
+	err = validateAllocationsKept(oldPool, newPool, "", []corev1.Service{service})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	newPool.Spec.Addresses = []string{"172.20.0.0/25"}
+	service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "172.20.0.10"}}
+	err = validateAllocationsKept(oldPool, newPool, "", []corev1.Service{service})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Reserving an assigned address leaves it out of the config
+	newPool = oldPool.DeepCopy()
+	newPool.Spec.ReserveAddresses = []string{"172.20.0.10"}
+	err = validateAllocationsKept(oldPool, newPool, "", []corev1.Service{service})
+	g.Expect(err).To(MatchError(ContainSubstring("address 172.20.0.10 assigned to service default/web")))
+
+	newPool.Spec.ReserveAddresses = []string{"172.20.0.1"}
+	err = validateAllocationsKept(oldPool, newPool, "", []corev1.Service{service})
+	g.Expect(err).NotTo(HaveOccurred())
+}
+
+func TestValidateAllocationsKeptOverlays(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	oldPool := &AddressPool{
+		Spec: AddressPoolSpec{
+			Name:      "gold",
+			Protocol:  "layer2",
+			Addresses: []string{"172.20.0.0/24"},
+			Overlays: []AddressPoolOverlay{
+				{Environment: "staging", Addresses: []string{"172.50.0.0/24"}},
+			},
+		},
+	}
+	service := corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: "172.50.0.10"}},
+			},
+		},
+	}
+
+	// The overlay of the selected environment replaces the addresses in use
+	newPool := oldPool.DeepCopy()
+	newPool.Spec.Overlays[0].Addresses = []string{"172.60.0.0/24"}
+	err := validateAllocationsKept(oldPool, newPool, "staging", []corev1.Service{service})
+	g.Expect(err).To(MatchError(ContainSubstring("address 172.50.0.10 assigned to service default/web")))
+
+	// The overlay of another environment doesn't hold the addresses in use
+	err = validateAllocationsKept(oldPool, newPool, "production", []corev1.Service{service})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// The reserved addresses are left out of the overlaid addresses
+	newPool = oldPool.DeepCopy()
+	newPool.Spec.ReserveAddresses = []string{"172.50.0.10"}
+	err = validateAllocationsKept(oldPool, newPool, "staging", []corev1.Service{service})
+	g.Expect(err).To(MatchError(ContainSubstring("address 172.50.0.10 assigned to service default/web")))
+}
+
+func TestValidateOverlaps(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	newPool := func(name string, addresses ...string) AddressPool {
+		return AddressPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "metallb-system"},
+			Spec: AddressPoolSpec{
+				Name:      name,
+				Protocol:  "layer2",
+				Addresses: addresses,
+			},
+		}
+	}
+
+	gold := newPool("gold", "172.20.0.0/24")
+	silver := newPool("silver", "172.20.0.100-172.20.1.10")
+	bronze := newPool("bronze", "172.30.0.0/24")
+	pools := []AddressPool{gold, bronze}
+
+	err := validateOverlaps(&silver, pools)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("pool silver overlap with the ones of pool gold"))
+
+	g.Expect(validateOverlaps(&gold, pools)).To(Succeed())
+
+	silver.Annotations = map[string]string{SharedAddressesAnnotation: "true"}
+	g.Expect(validateOverlaps(&silver, pools)).NotTo(Succeed())
+
+	pools[0].Annotations = map[string]string{SharedAddressesAnnotation: "true"}
+	g.Expect(validateOverlaps(&silver, pools)).To(Succeed())
+}
+
+func TestValidateReservations(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	pool := &AddressPool{
+		Spec: AddressPoolSpec{
+			Name:             "gold",
+			Protocol:         "layer2",
+			Addresses:        []string{"172.20.0.0/24"},
+			ReserveAddresses: []string{"172.20.0.1"},
+			Overlays: []AddressPoolOverlay{
+				{Environment: "staging", Addresses: []string{"172.20.0.0/25"}},
+			},
+		},
+	}
+	g.Expect(validateReservations(pool)).To(Succeed())
+
+	pool.Spec.ReserveAddresses = []string{"172.20.1.1"}
+	err := validateReservations(pool)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("172.20.1.1 is not part of the addresses of the pool"))
+
+	pool.Spec.ReserveAddresses = []string{"172.20.0.200"}
+	err = validateReservations(pool)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("in environment staging"))
+}
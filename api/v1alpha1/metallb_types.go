@@ -30,8 +30,85 @@ type MetallbSpec struct {
 
 	// Foo is an example field of Metallb. Edit Metallb_types.go to remove/update
 	MetallbImage string `json:"image,omitempty"`
+
+	// Environment selects the overlays of the AddressPool objects
+	// applied to the MetalLB config, e.g. staging or production
+	// +optional
+	Environment string `json:"environment,omitempty"`
+
+	// DefaultAddressPools maps namespaces to the name of the address pool
+	// the LoadBalancer services of the namespace requesting no specific pool
+	// are annotated with, when the webhooks are enabled
+	// +optional
+	DefaultAddressPools map[string]string `json:"defaultAddressPools,omitempty"`
+
+	// ConfigMapLabels are added to the MetalLB "config" ConfigMap
+	// generated from the AddressPool objects
+	// +optional
+	ConfigMapLabels map[string]string `json:"configMapLabels,omitempty"`
+
+	// ConfigIndent is the indentation width of the MetalLB config written
+	// to the "config" ConfigMap, defaults to 2
+	// +kubebuilder:validation:Minimum:=2
+	// +kubebuilder:validation:Maximum:=8
+	// +optional
+	ConfigIndent int `json:"configIndent,omitempty"`
+
+	// SortAddresses sorts the addresses of each pool of the MetalLB config,
+	// so that reordering them in the AddressPool objects doesn't change it
+	// +optional
+	SortAddresses bool `json:"sortAddresses,omitempty"`
+
+	// SpeakerWorkloadType is the kind of workload the speaker is deployed as
+	// +kubebuilder:validation:Enum:=daemonset;deployment
+	// +kubebuilder:default:=daemonset
+	// +optional
+	SpeakerWorkloadType string `json:"speakerWorkloadType,omitempty"`
+
+	// ControllerMetricsBindAddress is the IP address the MetalLB controller
+	// exposes its metrics on
+	// +optional
+	ControllerMetricsBindAddress string `json:"controllerMetricsBindAddress,omitempty"`
+
+	// SecureMetrics serves the metrics of the MetalLB controller over HTTPS
+	// through a kube-rbac-proxy sidecar, authorizing the scrapers against
+	// the Kubernetes API
+	// +optional
+	SecureMetrics bool `json:"secureMetrics,omitempty"`
+
+	// WaitForReadiness reports the Metallb resource as Available only once
+	// the pods of the MetalLB controller and speakers are running and ready
+	// +optional
+	WaitForReadiness bool `json:"waitForReadiness,omitempty"`
+
+	// EnableGrafanaDashboard creates a ConfigMap containing a MetalLB
+	// dashboard, to be loaded by the Grafana dashboards sidecar
+	// +optional
+	EnableGrafanaDashboard bool `json:"enableGrafanaDashboard,omitempty"`
+
+	// RunAsUser is the UID the processes of the MetalLB pods run as
+	// +optional
+	RunAsUser *int64 `json:"runAsUser,omitempty"`
+
+	// FSGroup is the supplemental group the volumes of the MetalLB pods
+	// are owned by
+	// +optional
+	FSGroup *int64 `json:"fsGroup,omitempty"`
+
+	// SpeakerAnnotations are added to the metadata of the speaker
+	// workload object, e.g. for the sync waves of a GitOps tool
+	// +optional
+	SpeakerAnnotations map[string]string `json:"speakerAnnotations,omitempty"`
 }
 
+const (
+	// SpeakerWorkloadDaemonSet deploys the speaker on every node
+	SpeakerWorkloadDaemonSet = "daemonset"
+	// SpeakerWorkloadDeployment deploys a single speaker replica,
+	// intended for single node clusters
+	SpeakerWorkloadDeployment = "deployment"
+)
+
 // MetallbStatus defines the observed state of Metallb
 type MetallbStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
@@ -39,8 +116,28 @@ type MetallbStatus struct {
 
 	// Conditions show the current state of the metallb operator
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// ConfigSchema shows the schema of the MetalLB configuration
+	// the operator is currently emitting
+	// +optional
+	ConfigSchema ConfigSchema `json:"configSchema,omitempty"`
 }
 
+// ConfigSchema describes the format of the generated MetalLB configuration
+type ConfigSchema struct {
+	// Mode is the kind of object the configuration is emitted as
+	Mode string `json:"mode,omitempty"`
+
+	// APIVersion is the apiVersion of the emitted configuration objects
+	APIVersion string `json:"apiVersion,omitempty"`
+}
+
+const (
+	// ConfigSchemaModeConfigMap is used when the configuration is emitted
+	// as the MetalLB "config" ConfigMap
+	ConfigSchemaModeConfigMap = "ConfigMap"
+)
+
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 
@@ -0,0 +1,103 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var metallblog = logf.Log.WithName("metallb-resource")
+
+// allowedRegistries are the registries, or repositories of a registry, the
+// images of the Metallb resource may be pulled from. All are allowed when empty.
+var allowedRegistries []string
+
+// SetupWebhookWithManager registers the Metallb validating webhook.
+// registries lists the registries the images of the resource may be pulled
+// from, e.g. "quay.io" or "quay.io/metallb", all of them being allowed when empty.
+func (r *Metallb) SetupWebhookWithManager(mgr ctrl.Manager, registries []string) error {
+	allowedRegistries = registries
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-metallb-io-v1alpha1-metallb,mutating=false,failurePolicy=fail,groups=metallb.io,resources=metallbs,versions=v1alpha1,name=vmetallb.kb.io
+
+var _ webhook.Validator = &Metallb{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *Metallb) ValidateCreate() error {
+	metallblog.Info("validate create", "name", r.Name)
+	return validateImageRegistry(r.Spec.MetallbImage, allowedRegistries)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *Metallb) ValidateUpdate(old runtime.Object) error {
+	metallblog.Info("validate update", "name", r.Name)
+	return validateImageRegistry(r.Spec.MetallbImage, allowedRegistries)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *Metallb) ValidateDelete() error {
+	return nil
+}
+
+// validateImageRegistry rejects the images not pulled from one of the
+// allowed registries
+func validateImageRegistry(image string, registries []string) error {
+	if image == "" || len(registries) == 0 {
+		return nil
+	}
+	repository := imageRepository(image)
+	for _, registry := range registries {
+		registry = strings.TrimSuffix(registry, "/")
+		if repository == registry || strings.HasPrefix(repository, registry+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s is not pulled from an allowed registry, the allowed registries are %s",
+		image, strings.Join(registries, ", "))
+}
+
+// imageRepository returns the repository of the image, including its registry,
+// e.g. docker.io/library/busybox for busybox:latest
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	components := strings.SplitN(image, "/", 2)
+	if len(components) == 1 {
+		return "docker.io/library/" + image
+	}
+	domain := components[0]
+	if !strings.ContainsAny(domain, ".:") && domain != "localhost" {
+		return "docker.io/" + image
+	}
+	return image
+}
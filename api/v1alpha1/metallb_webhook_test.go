@@ -0,0 +1,43 @@
+package v1alpha1
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestValidateImageRegistry(t *testing.T) {
+	registries := []string{"quay.io/metallb", "registry.example.com:5000/"}
+
+	tests := []struct {
+		image   string
+		allowed bool
+	}{
+		{image: "", allowed: true},
+		{image: "quay.io/metallb/controller:v0.9.6", allowed: true},
+		{image: "quay.io/metallb/speaker@sha256:0123456789abcdef", allowed: true},
+		{image: "registry.example.com:5000/metallb/speaker", allowed: true},
+		{image: "quay.io/metallbfork/controller:v0.9.6", allowed: false},
+		{image: "quay.io/other/controller", allowed: false},
+		{image: "metallb/controller:v0.9.6", allowed: false},
+		{image: "controller", allowed: false},
+		{image: "registry.example.com/metallb/speaker", allowed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			err := validateImageRegistry(test.image, registries)
+			if test.allowed {
+				g.Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(err.Error()).To(ContainSubstring("is not pulled from an allowed registry"))
+		})
+	}
+
+	g := NewGomegaWithT(t)
+	g.Expect(validateImageRegistry("metallb/controller", nil)).To(Succeed())
+	g.Expect(validateImageRegistry("metallb/controller", []string{"docker.io"})).To(Succeed())
+	g.Expect(validateImageRegistry("busybox:latest", []string{"docker.io/library"})).To(Succeed())
+}
@@ -31,7 +31,7 @@ func (in *AddressPool) DeepCopyInto(out *AddressPool) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AddressPool.
@@ -84,6 +84,31 @@ func (in *AddressPoolList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AddressPoolOverlay) DeepCopyInto(out *AddressPoolOverlay) {
+	*out = *in
+	if in.Addresses != nil {
+		in, out := &in.Addresses, &out.Addresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AutoAssign != nil {
+		in, out := &in.AutoAssign, &out.AutoAssign
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AddressPoolOverlay.
+func (in *AddressPoolOverlay) DeepCopy() *AddressPoolOverlay {
+	if in == nil {
+		return nil
+	}
+	out := new(AddressPoolOverlay)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AddressPoolSpec) DeepCopyInto(out *AddressPoolSpec) {
 	*out = *in
@@ -92,11 +117,28 @@ func (in *AddressPoolSpec) DeepCopyInto(out *AddressPoolSpec) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.ReserveAddresses != nil {
+		in, out := &in.ReserveAddresses, &out.ReserveAddresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	if in.AutoAssign != nil {
 		in, out := &in.AutoAssign, &out.AutoAssign
 		*out = new(bool)
 		**out = **in
 	}
+	if in.MaxAllocations != nil {
+		in, out := &in.MaxAllocations, &out.MaxAllocations
+		*out = new(int)
+		**out = **in
+	}
+	if in.Overlays != nil {
+		in, out := &in.Overlays, &out.Overlays
+		*out = make([]AddressPoolOverlay, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AddressPoolSpec.
@@ -112,6 +154,13 @@ func (in *AddressPoolSpec) DeepCopy() *AddressPoolSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AddressPoolStatus) DeepCopyInto(out *AddressPoolStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AddressPoolStatus.
@@ -124,12 +173,27 @@ func (in *AddressPoolStatus) DeepCopy() *AddressPoolStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigSchema) DeepCopyInto(out *ConfigSchema) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigSchema.
+func (in *ConfigSchema) DeepCopy() *ConfigSchema {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigSchema)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Metallb) DeepCopyInto(out *Metallb) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 	in.Status.DeepCopyInto(&out.Status)
 }
 
@@ -186,6 +250,37 @@ func (in *MetallbList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *MetallbSpec) DeepCopyInto(out *MetallbSpec) {
 	*out = *in
+	if in.DefaultAddressPools != nil {
+		in, out := &in.DefaultAddressPools, &out.DefaultAddressPools
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.ConfigMapLabels != nil {
+		in, out := &in.ConfigMapLabels, &out.ConfigMapLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.RunAsUser != nil {
+		in, out := &in.RunAsUser, &out.RunAsUser
+		*out = new(int64)
+		**out = **in
+	}
+	if in.FSGroup != nil {
+		in, out := &in.FSGroup, &out.FSGroup
+		*out = new(int64)
+		**out = **in
+	}
+	if in.SpeakerAnnotations != nil {
+		in, out := &in.SpeakerAnnotations, &out.SpeakerAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetallbSpec.
@@ -208,6 +303,7 @@ func (in *MetallbStatus) DeepCopyInto(out *MetallbStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	out.ConfigSchema = in.ConfigSchema
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetallbStatus.
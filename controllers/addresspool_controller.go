@@ -25,12 +25,24 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"reflect"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"time"
 
 	metallbv1alpha1 "github.com/metallb/metallb-operator/api/v1alpha1"
 	"github.com/metallb/metallb-operator/pkg/apply"
+	"github.com/metallb/metallb-operator/pkg/pool"
 	"github.com/metallb/metallb-operator/pkg/render"
 )
 
@@ -39,15 +51,18 @@ type AddressPoolReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+	// MaxConcurrentReconciles is the maximum number of AddressPool objects
+	// reconciled in parallel, defaults to 1
+	MaxConcurrentReconciles int
 }
 
-const (
-	AddressPoolManifestPath = "./bindata/configuration/address-pool"
-	RetryPeriod             = 5 * time.Minute
-)
+var AddressPoolManifestPath = "./bindata/configuration/address-pool"
+
+const RetryPeriod = 5 * time.Minute
 
 // +kubebuilder:rbac:groups=metallb.io,resources=addresspools,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=metallb.io,resources=addresspools/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",namespace=metallb-system,resources=secrets,verbs=get;list;watch
 
 func (r *AddressPoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	r.Log.Info(fmt.Sprintf("Starting AddressPool reconcile loop for %v", req.NamespacedName))
@@ -57,13 +72,20 @@ func (r *AddressPoolReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 
 	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
 		if errors.IsNotFound(err) {
-			err = r.syncMetallbAddressPools(req)
+			// The name of the deleted pool is unknown, only the pools with
+			// its source comment are removed
+			err = r.removeConfigPool(req, "")
 			if err != nil {
 				return ctrl.Result{}, err
 			}
 		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	if isSkipped(instance) {
+		// The pool may have been part of the config before being labeled
+		r.Log.Info(fmt.Sprintf("Skipping addresspool %v", req.NamespacedName))
+		return ctrl.Result{}, r.removeConfigPool(req, instance.Spec.Name)
+	}
 	err := r.syncMetalLBAddressPool(instance)
 	if err != nil {
 		r.Log.Info(fmt.Sprintf("sync MetalLB addresspool failed %s", err))
@@ -73,12 +95,18 @@ func (r *AddressPoolReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	return ctrl.Result{}, nil
 }
 
-func renderObject(instance *metallbv1alpha1.AddressPool) ([]*unstructured.Unstructured, error) {
+func renderObject(instance *metallbv1alpha1.AddressPool, environment string) ([]*unstructured.Unstructured, error) {
+	spec := instance.OverlaidSpec(environment)
+	addresses, err := pool.ExcludeAddresses(spec.Addresses, spec.ReserveAddresses)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to reserve the addresses of pool %s %v", spec.Name, err)
+	}
 	data := render.MakeRenderData()
-	data.Data["Name"] = instance.Spec.Name
-	data.Data["Protocol"] = instance.Spec.Protocol
-	data.Data["AutoAssign"] = *instance.Spec.AutoAssign
-	data.Data["Addresses"] = instance.Spec.Addresses
+	data.Data["Name"] = spec.Name
+	data.Data["Protocol"] = spec.Protocol
+	data.Data["AutoAssign"] = *spec.AutoAssign
+	data.Data["Addresses"] = addresses
+	data.Data["Source"] = instance.Namespace + "/" + instance.Name
 	objs, err := render.RenderDir(AddressPoolManifestPath, &data)
 	if err != nil {
 		return nil, fmt.Errorf("Fail to render address-pool manifest %v", err)
@@ -91,71 +119,207 @@ func renderObject(instance *metallbv1alpha1.AddressPool) ([]*unstructured.Unstru
 	return objs, err
 }
 
+// isSkipped returns true if the pool is labeled to be left out of the config
+func isSkipped(instance *metallbv1alpha1.AddressPool) bool {
+	return instance.Labels[metallbv1alpha1.SkipLabel] == "true"
+}
+
+// metallb returns the Metallb resource of the namespace, which holds the
+// settings of the config ConfigMap. When there is none, an empty one is
+// returned, without a UID.
+func (r *AddressPoolReconciler) metallb(namespace string) (*metallbv1alpha1.Metallb, error) {
+	metallb := &metallbv1alpha1.Metallb{}
+	err := r.Get(context.Background(), types.NamespacedName{Name: defaultMetallbCrName, Namespace: namespace}, metallb)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	return metallb, nil
+}
+
+// setConfigMapSettings applies the settings of the Metallb resource to the
+// config ConfigMap, and makes the resource the owner of the ConfigMap so that
+// it is garbage collected along with it
+func (r *AddressPoolReconciler) setConfigMapSettings(obj *unstructured.Unstructured, metallb *metallbv1alpha1.Metallb) error {
+	apply.SetManagedLabels(obj, metallb.Spec.ConfigMapLabels)
+	if err := apply.SetConfigIndent(obj, metallb.Spec.ConfigIndent); err != nil {
+		return err
+	}
+	if err := apply.SetSortAddresses(obj, metallb.Spec.SortAddresses); err != nil {
+		return err
+	}
+	if metallb.UID == "" {
+		return nil
+	}
+	return controllerutil.SetControllerReference(metallb, obj, r.Scheme)
+}
+
 func (r *AddressPoolReconciler) syncMetalLBAddressPool(instance *metallbv1alpha1.AddressPool) error {
-	objs, err := renderObject(instance)
+	metallb, err := r.metallb(instance.Namespace)
+	if err != nil {
+		return fmt.Errorf("Failed to get the configmap settings %v", err)
+	}
+
+	objs, err := renderObject(instance, metallb.Spec.Environment)
 
 	if err != nil {
 		return fmt.Errorf("Fail to render address-pool manifest %v", err)
 	}
 
+	secrets := &apply.SecretResolver{Client: r.Client, Namespace: instance.Namespace}
 	for _, obj := range objs {
-		if err := apply.ApplyObject(context.Background(), r.Client, obj); err != nil {
-			err = fmt.Errorf("could not apply (%s) %s/%s err %v", obj.GroupVersionKind(),
-				obj.GetNamespace(), obj.GetName(), err)
+		if err := r.setConfigMapSettings(obj, metallb); err != nil {
+			return fmt.Errorf("Failed to apply the configmap settings %v", err)
+		}
+
+		reload, err := r.configReload(obj)
+		if err != nil {
+			return fmt.Errorf("Failed to classify the config change %v", secrets.RedactError(err))
+		}
+
+		changed, err := r.applyConfigMap(obj, secrets)
+		if err != nil {
+			return fmt.Errorf("could not apply (%s) %s/%s err %v", obj.GroupVersionKind(),
+				obj.GetNamespace(), obj.GetName(), secrets.RedactError(err))
+		}
+
+		// The pool may be reconciled again without changing the config, e.g.
+		// when the Metallb resource changes, the reload of its last change
+		// being kept then
+		if !changed {
+			continue
+		}
+		if err := r.setConfigReload(instance, reload); err != nil {
+			return fmt.Errorf("Failed to update the addresspool status %v", err)
 		}
 	}
 
-	return err
+	return nil
 }
 
-func (r *AddressPoolReconciler) syncMetallbAddressPools(req ctrl.Request) error {
-	instanceList := &metallbv1alpha1.AddressPoolList{}
-	objs := make([]*unstructured.Unstructured, 0)
-
-	configMap := &corev1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "config",
-			Namespace: req.Namespace,
-		},
+// configReload returns how MetalLB picks up the change of the existing
+// config ConfigMap to obj
+func (r *AddressPoolReconciler) configReload(obj *unstructured.Unstructured) (string, error) {
+	current := &unstructured.Unstructured{}
+	current.SetGroupVersionKind(obj.GroupVersionKind())
+	err := r.Get(context.Background(), types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}, current)
+	if errors.IsNotFound(err) {
+		return apply.ConfigReload(nil, obj)
+	}
+	if err != nil {
+		return "", err
 	}
+	return apply.ConfigReload(current, obj)
+}
 
-	// Delete the exiting configMap
-	if err := r.Delete(context.Background(), configMap); err != nil {
-		// if we don't have ConfigMap then there is nothing to do
-		if errors.IsNotFound(err) {
+// setConfigReload records in the status of the pool how MetalLB picks up its
+// last change. The status is also updated by the AddressPoolStatusReconciler,
+// so the pool is fetched again on conflicts.
+func (r *AddressPoolReconciler) setConfigReload(instance *metallbv1alpha1.AddressPool, reload string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current := &metallbv1alpha1.AddressPool{}
+		if err := r.Get(context.Background(), types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, current); err != nil {
+			return err
+		}
+		if current.Status.ConfigReload == reload {
 			return nil
 		}
-		r.Log.Info(fmt.Sprintf("Failed to delete existing Configmap %s", err))
+		current.Status.ConfigReload = reload
+		return r.Status().Update(context.Background(), current)
+	})
+}
+
+// removeConfigPool removes the pool of the request from the config once it is
+// deleted or skipped. The ConfigMap is only updated when it holds the pool, so
+// that MetalLB doesn't reload its config on every reconcile of a skipped pool.
+// The pools named poolName without source comment, written by the previous
+// versions of the operator, are removed too.
+func (r *AddressPoolReconciler) removeConfigPool(req ctrl.Request, poolName string) error {
+	source := req.Namespace + "/" + req.Name
+	secrets := &apply.SecretResolver{Client: r.Client, Namespace: req.Namespace}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		return apply.RemoveConfigPools(context.Background(), r.Client, req.Namespace, source, poolName, secrets)
+	})
+	return secrets.RedactError(err)
+}
+
+// applyConfigMap merges the config ConfigMap with the existing one, resolving
+// the placeholders of the merged config. As multiple reconciles may run
+// concurrently, the apply is retried when the ConfigMap was created or updated
+// in the meantime. It returns true if the ConfigMap was created or updated.
+func (r *AddressPoolReconciler) applyConfigMap(obj *unstructured.Unstructured, secrets *apply.SecretResolver) (bool, error) {
+	var changed bool
+	err := retry.OnError(retry.DefaultRetry, isWriteConflict, func() error {
+		var err error
+		// The object is modified by the merge with the existing ConfigMap
+		changed, err = apply.ApplyConfigMap(context.Background(), r.Client, obj.DeepCopy(), secrets)
 		return err
-	}
+	})
+	return changed, err
+}
+
+func isWriteConflict(err error) bool {
+	return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+}
 
-	if err := r.List(context.Background(), instanceList); err != nil {
+// poolsForNamespace enqueues the AddressPool objects of the namespace of the
+// Metallb resource, as its settings apply to the config generated from them
+func (r *AddressPoolReconciler) poolsForNamespace(obj client.Object) []reconcile.Request {
+	pools := &metallbv1alpha1.AddressPoolList{}
+	if err := r.List(context.Background(), pools, client.InNamespace(obj.GetNamespace())); err != nil {
 		r.Log.Info(fmt.Sprintf("Failed to get existing addresspool objects %s", err))
-		return err
+		return nil
 	}
 
-	for _, instance := range instanceList.Items {
-		objslist, err := renderObject(&instance)
-		if err != nil {
-			return fmt.Errorf("Failed to render address-pool manifest %v", err)
-		}
-
-		for _, obj := range objslist {
-			objs = append(objs, obj)
-		}
+	requests := make([]reconcile.Request, 0, len(pools.Items))
+	for _, p := range pools.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: p.Namespace, Name: p.Name},
+		})
 	}
+	return requests
+}
 
-	if len(objs) > 0 {
-		if err := apply.ApplyObjects(context.Background(), r.Client, objs); err != nil {
-			return fmt.Errorf("Failed to ApplyObjects %v", err)
-		}
+// poolsForConfigMap enqueues the AddressPool objects of the namespace when the
+// config ConfigMap is not owned by the Metallb resource anymore, e.g. after a
+// migration, so that the owner reference is restored
+func (r *AddressPoolReconciler) poolsForConfigMap(obj client.Object) []reconcile.Request {
+	metallb, err := r.metallb(obj.GetNamespace())
+	if err != nil || metallb.UID == "" {
+		return nil
+	}
+	if owner := metav1.GetControllerOf(obj); owner != nil && owner.UID == metallb.UID {
+		return nil
 	}
+	return r.poolsForNamespace(obj)
+}
 
-	return nil
+// configMapPredicate filters the config ConfigMap
+var configMapPredicate = predicate.NewPredicateFuncs(func(obj client.Object) bool {
+	return obj.GetName() == apply.AddressPoolConfigMap
+})
+
+// labelChangedPredicate filters the updates changing the labels of the
+// object, as the skip label changes whether the pool is part of the config
+var labelChangedPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return !reflect.DeepEqual(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels())
+	},
 }
 
 func (r *AddressPoolReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// The status updates of the AddressPool objects don't change the config
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&metallbv1alpha1.AddressPool{}).
+		For(&metallbv1alpha1.AddressPool{},
+			builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, labelChangedPredicate))).
+		Watches(&source.Kind{Type: &metallbv1alpha1.Metallb{}}, handler.EnqueueRequestsFromMapFunc(r.poolsForNamespace),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.poolsForConfigMap),
+			builder.WithPredicates(configMapPredicate)).
+		WithOptions(r.ControllerOptions()).
 		Complete(r)
 }
+
+// ControllerOptions returns the options the AddressPool controller is built with
+func (r *AddressPoolReconciler) ControllerOptions() controller.Options {
+	return controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}
+}
@@ -0,0 +1,396 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/metallb/metallb-operator/api/v1alpha1"
+	"github.com/metallb/metallb-operator/pkg/apply"
+	"github.com/metallb/metallb-operator/test/consts"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("AddressPool Controller", func() {
+	Context("syncMetalLBAddressPool", func() {
+		AfterEach(func() {
+			err := k8sClient.DeleteAllOf(context.Background(), &v1alpha1.AddressPool{}, client.InNamespace(consts.MetallbNameSpace))
+			Expect(err).ToNot(HaveOccurred())
+			err = k8sClient.DeleteAllOf(context.Background(), &v1alpha1.Metallb{}, client.InNamespace(consts.MetallbNameSpace))
+			Expect(err).ToNot(HaveOccurred())
+			err = cleanTestNamespace()
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("Should leave the skipped pools out of the config", func() {
+			By("Creating a skipped AddressPool resource")
+			skipped := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "skipped-addresspool",
+					Namespace: consts.MetallbNameSpace,
+					Labels:    map[string]string{v1alpha1.SkipLabel: "true"},
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "skipped",
+					Protocol:  "layer2",
+					Addresses: []string{"172.40.0.0/24"},
+				},
+			}
+			err := k8sClient.Create(context.Background(), skipped)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Creating an AddressPool resource")
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "test-addresspool",
+					Protocol:  "layer2",
+					Addresses: []string{"172.20.0.0/24"},
+				},
+			}
+			err = k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that only the pool not skipped is in the config")
+			config := func() string {
+				configMap := &corev1.ConfigMap{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: "config", Namespace: consts.MetallbNameSpace}, configMap)
+				if err != nil {
+					return ""
+				}
+				return configMap.Data["config"]
+			}
+			Eventually(config, 2*time.Second, 200*time.Millisecond).Should(ContainSubstring("172.20.0.0/24"))
+			Consistently(config, time.Second, 200*time.Millisecond).ShouldNot(ContainSubstring("172.40.0.0/24"))
+		})
+		It("Should remove the pool labeled as skipped from the config", func() {
+			By("Creating an AddressPool resource")
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "test-addresspool",
+					Protocol:  "bgp",
+					Addresses: []string{"172.20.0.0/24"},
+				},
+			}
+			err := k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			configMap := &corev1.ConfigMap{}
+			config := func() string {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: "config", Namespace: consts.MetallbNameSpace}, configMap)
+				if err != nil {
+					return ""
+				}
+				return configMap.Data["config"]
+			}
+			Eventually(config, 2*time.Second, 200*time.Millisecond).Should(ContainSubstring("172.20.0.0/24"))
+
+			By("Adding a peer to the config")
+			configMap.Data["config"] = "peers:\n- peer-address: 10.0.0.1\n  peer-asn: 64501\n  my-asn: 64500\n" + configMap.Data["config"]
+			err = k8sClient.Update(context.Background(), configMap)
+			Expect(err).ToNot(HaveOccurred())
+			uid := configMap.UID
+
+			By("Labeling the pool as skipped")
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, addressPool)
+			Expect(err).ToNot(HaveOccurred())
+			addressPool.Labels = map[string]string{v1alpha1.SkipLabel: "true"}
+			err = k8sClient.Update(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the pool is removed from the config, keeping the peer")
+			Eventually(config, 2*time.Second, 200*time.Millisecond).ShouldNot(ContainSubstring("172.20.0.0/24"))
+			Expect(config()).To(ContainSubstring("peer-address: 10.0.0.1"))
+			Expect(configMap.UID).To(Equal(uid))
+		})
+		It("Should resolve the secrets of the peers of the config", func() {
+			By("Creating a Secret and a config with a peer referencing it")
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "bgp-auth", Namespace: consts.MetallbNameSpace},
+				Data:       map[string][]byte{"password": []byte("s3cr3t")},
+			}
+			err := k8sClient.Create(context.Background(), secret)
+			Expect(err).ToNot(HaveOccurred())
+			defer func() {
+				Expect(k8sClient.Delete(context.Background(), secret)).To(Succeed())
+			}()
+			configMap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: consts.MetallbNameSpace},
+				Data: map[string]string{
+					"config": "peers:\n- peer-address: 10.0.0.1\n  peer-asn: 64501\n  my-asn: 64500\n" +
+						"  password: ${secret:bgp-auth/password}\naddress-pools: []\n",
+				},
+			}
+			err = k8sClient.Create(context.Background(), configMap)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Creating an AddressPool resource")
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "test-addresspool",
+					Protocol:  "bgp",
+					Addresses: []string{"172.20.0.0/24"},
+				},
+			}
+			err = k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the password of the peer is resolved")
+			config := func() string {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: "config", Namespace: consts.MetallbNameSpace}, configMap)
+				if err != nil {
+					return ""
+				}
+				return configMap.Data["config"]
+			}
+			Eventually(config, 2*time.Second, 200*time.Millisecond).Should(And(
+				ContainSubstring("172.20.0.0/24"),
+				ContainSubstring("password: s3cr3t"),
+			))
+			Expect(config()).NotTo(ContainSubstring("${secret:"))
+			Expect(configMap.Annotations[apply.ConfigTemplateAnnotation]).To(ContainSubstring("${secret:bgp-auth/password}"))
+		})
+		It("Should apply the overlay of the selected environment", func() {
+			By("Creating a Metallb resource selecting the staging environment")
+			metallb := newTestMetallb()
+			metallb.Spec.Environment = "staging"
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Creating an AddressPool resource with overlays")
+			autoAssign := false
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "test-addresspool",
+					Protocol:  "layer2",
+					Addresses: []string{"172.20.0.0/24"},
+					Overlays: []v1alpha1.AddressPoolOverlay{
+						{
+							Environment: "staging",
+							Addresses:   []string{"172.50.0.0/24"},
+							AutoAssign:  &autoAssign,
+						},
+						{
+							Environment: "production",
+							Addresses:   []string{"172.60.0.0/24"},
+						},
+					},
+				},
+			}
+			err = k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the staging overlay is in the config")
+			config := func() string {
+				configMap := &corev1.ConfigMap{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: "config", Namespace: consts.MetallbNameSpace}, configMap)
+				if err != nil {
+					return ""
+				}
+				return configMap.Data["config"]
+			}
+			Eventually(config, 2*time.Second, 200*time.Millisecond).Should(And(
+				ContainSubstring("172.50.0.0/24"),
+				ContainSubstring("auto-assign: false"),
+			))
+			Expect(config()).NotTo(ContainSubstring("172.20.0.0/24"))
+			Expect(config()).NotTo(ContainSubstring("172.60.0.0/24"))
+			Expect(config()).NotTo(ContainSubstring("overlays"))
+		})
+		It("Should leave the reserved addresses out of the config", func() {
+			By("Creating an AddressPool resource reserving its gateway")
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:             "test-addresspool",
+					Protocol:         "layer2",
+					Addresses:        []string{"172.20.0.0/24"},
+					ReserveAddresses: []string{"172.20.0.1"},
+				},
+			}
+			err := k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the range is split around the reserved address")
+			config := func() string {
+				configMap := &corev1.ConfigMap{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: "config", Namespace: consts.MetallbNameSpace}, configMap)
+				if err != nil {
+					return ""
+				}
+				return configMap.Data["config"]
+			}
+			Eventually(config, 2*time.Second, 200*time.Millisecond).Should(And(
+				ContainSubstring("172.20.0.0/32"),
+				ContainSubstring("172.20.0.2-172.20.0.255"),
+			))
+			Expect(config()).NotTo(ContainSubstring("172.20.0.0/24"))
+			Expect(config()).NotTo(ContainSubstring("reserveAddresses"))
+		})
+		It("Should keep a single entry of a pool reconciled again", func() {
+			By("Creating an AddressPool resource")
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "test-addresspool",
+					Protocol:  "layer2",
+					Addresses: []string{"172.20.0.0/24"},
+				},
+			}
+			err := k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			config := func() string {
+				configMap := &corev1.ConfigMap{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: "config", Namespace: consts.MetallbNameSpace}, configMap)
+				if err != nil {
+					return ""
+				}
+				return configMap.Data["config"]
+			}
+			Eventually(config, 2*time.Second, 200*time.Millisecond).Should(ContainSubstring("172.20.0.0/24"))
+
+			By("Reconciling the pool twice")
+			reconciler := &AddressPoolReconciler{
+				Client: k8sClient,
+				Scheme: scheme.Scheme,
+				Log:    ctrl.Log.WithName("controllers").WithName("AddressPool"),
+			}
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}}
+			for i := 0; i < 2; i++ {
+				_, err = reconciler.Reconcile(context.Background(), req)
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			By("Validating that the config holds a single entry of the pool")
+			entries := func() int {
+				return strings.Count(config(), "- name: test-addresspool")
+			}
+			Consistently(entries, time.Second, 200*time.Millisecond).Should(Equal(1))
+		})
+		It("Should report whether the change of the pool requires a restart", func() {
+			By("Creating an AddressPool resource")
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "test-addresspool",
+					Protocol:  "layer2",
+					Addresses: []string{"172.20.0.0/24"},
+				},
+			}
+			err := k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			configReload := func() string {
+				instance := &v1alpha1.AddressPool{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, instance)
+				if err != nil {
+					return ""
+				}
+				return instance.Status.ConfigReload
+			}
+			Eventually(configReload, 2*time.Second, 200*time.Millisecond).Should(Equal(v1alpha1.ConfigReloadHot))
+
+			By("Changing the protocol of the pool")
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, addressPool)
+			Expect(err).ToNot(HaveOccurred())
+			addressPool.Spec.Protocol = "bgp"
+			err = k8sClient.Update(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(configReload, 2*time.Second, 200*time.Millisecond).Should(Equal(v1alpha1.ConfigReloadRestart))
+
+			By("Validating that reconciling the pool again keeps the reload of its last change")
+			reconciler := &AddressPoolReconciler{
+				Client: k8sClient,
+				Scheme: scheme.Scheme,
+				Log:    ctrl.Log.WithName("controllers").WithName("AddressPool"),
+			}
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}}
+			_, err = reconciler.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Consistently(configReload, time.Second, 200*time.Millisecond).Should(Equal(v1alpha1.ConfigReloadRestart))
+		})
+		It("Should restore the owner reference of the config", func() {
+			By("Creating a Metallb resource")
+			metallb := newTestMetallb()
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Creating an AddressPool resource")
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "test-addresspool",
+					Protocol:  "layer2",
+					Addresses: []string{"172.20.0.0/24"},
+				},
+			}
+			err = k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the config is owned by the Metallb resource")
+			owners := func() []metav1.OwnerReference {
+				configMap := &corev1.ConfigMap{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: "config", Namespace: consts.MetallbNameSpace}, configMap)
+				if err != nil {
+					return nil
+				}
+				return configMap.OwnerReferences
+			}
+			isOwnedByMetallb := WithTransform(func(refs []metav1.OwnerReference) types.UID {
+				for _, ref := range refs {
+					if ref.Controller != nil && *ref.Controller {
+						return ref.UID
+					}
+				}
+				return ""
+			}, Equal(metallb.UID))
+			Eventually(owners, 2*time.Second, 200*time.Millisecond).Should(isOwnedByMetallb)
+
+			By("Replacing the owner references by another owner")
+			configMap := &corev1.ConfigMap{}
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Name: "config", Namespace: consts.MetallbNameSpace}, configMap)
+			Expect(err).ToNot(HaveOccurred())
+			other := metav1.OwnerReference{APIVersion: "argoproj.io/v1alpha1", Kind: "Application", Name: "metallb", UID: "c0ffee"}
+			configMap.OwnerReferences = []metav1.OwnerReference{other}
+			err = k8sClient.Update(context.Background(), configMap)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the owner reference is restored along with the other one")
+			Eventually(owners, 2*time.Second, 200*time.Millisecond).Should(And(isOwnedByMetallb, ContainElement(other)))
+		})
+	})
+})
@@ -0,0 +1,338 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	metallbv1alpha1 "github.com/metallb/metallb-operator/api/v1alpha1"
+	"github.com/metallb/metallb-operator/pkg/pool"
+)
+
+// AddressPoolStatusReconciler updates the status of the AddressPool objects
+// with the utilization of the pools by the LoadBalancer services
+type AddressPoolStatusReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// ClusterCache is used to watch and list the services of all the namespaces,
+	// and the nodes, when the manager cache is restricted to the operator namespace.
+	// When not set, the manager cache is used.
+	ClusterCache cache.Cache
+	// Recorder emits the Warning events of the pools. When not set, the
+	// recorder of the manager is used.
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+func (r *AddressPoolStatusReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	instance := &metallbv1alpha1.AddressPool{}
+	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	environment, err := r.environment(ctx, instance.Namespace)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	// The pool is checked as it is in the config of the selected environment,
+	// without the reserved addresses MetalLB never assigns
+	spec := instance.OverlaidSpec(environment)
+	addresses, err := pool.ExcludeAddresses(spec.Addresses, spec.ReserveAddresses)
+	if err != nil {
+		r.Log.Info(fmt.Sprintf("Failed to reserve addresses of addresspool %v: %s", req.NamespacedName, err))
+		return ctrl.Result{}, nil
+	}
+	ranges, err := pool.ParseRanges(addresses)
+	if err != nil {
+		r.Log.Info(fmt.Sprintf("Failed to parse addresses of addresspool %v: %s", req.NamespacedName, err))
+		return ctrl.Result{}, nil
+	}
+
+	services := &corev1.ServiceList{}
+	if err := r.serviceReader().List(ctx, services); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	poolStatus := instance.Status.DeepCopy()
+	poolStatus.AllocatedAddresses = pool.AllocatedAddresses(pool.Allocations(ranges, services.Items))
+	r.checkCapacity(instance, poolStatus, ranges, services.Items)
+	r.checkAllocationLimit(instance, poolStatus)
+	checkUnused(instance, spec, poolStatus, ranges, services.Items)
+	r.checkSharingConflicts(instance, spec, poolStatus, services.Items)
+	r.checkDualStack(instance, poolStatus, ranges, services.Items)
+
+	nodes := &corev1.NodeList{}
+	if err := r.serviceReader().List(ctx, nodes); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.checkNodeSubnets(instance, poolStatus, ranges, nodes.Items)
+
+	if equality.Semantic.DeepEqual(&instance.Status, poolStatus) {
+		return ctrl.Result{}, nil
+	}
+	instance.Status = *poolStatus
+	if err := r.Status().Update(ctx, instance); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// checkCapacity warns when more LoadBalancer services request an address
+// from the pool than it holds. This is best effort, as the services not
+// requesting a specific pool may be served by any auto-assign pool.
+func (r *AddressPoolStatusReconciler) checkCapacity(instance *metallbv1alpha1.AddressPool, poolStatus *metallbv1alpha1.AddressPoolStatus,
+	ranges []pool.IPRange, services []corev1.Service) {
+	capacity := pool.Capacity(ranges)
+	requested := pool.RequestedAddresses(instance.Spec.Name, ranges, services)
+	if big.NewInt(int64(requested)).Cmp(capacity) <= 0 {
+		meta.RemoveStatusCondition(&poolStatus.Conditions, metallbv1alpha1.ConditionCapacityExceeded)
+		return
+	}
+
+	message := fmt.Sprintf("Pool %s holds %s addresses but %d are requested by LoadBalancer services",
+		instance.Spec.Name, capacity, requested)
+	r.warn(instance, poolStatus, metallbv1alpha1.ConditionCapacityExceeded, "NotEnoughAddresses", message)
+}
+
+// checkAllocationLimit warns when the LoadBalancer services use as many
+// addresses of the pool as its allocation limit, or more. MetalLB doesn't
+// know about the limit, so it can only be reported.
+func (r *AddressPoolStatusReconciler) checkAllocationLimit(instance *metallbv1alpha1.AddressPool, poolStatus *metallbv1alpha1.AddressPoolStatus) {
+	limit := instance.Spec.MaxAllocations
+	if limit == nil || poolStatus.AllocatedAddresses < *limit {
+		meta.RemoveStatusCondition(&poolStatus.Conditions, metallbv1alpha1.ConditionAllocationLimitReached)
+		return
+	}
+
+	message := fmt.Sprintf("Pool %s has %d addresses allocated, reaching its limit of %d",
+		instance.Spec.Name, poolStatus.AllocatedAddresses, *limit)
+	if poolStatus.AllocatedAddresses > *limit {
+		message = fmt.Sprintf("Pool %s has %d addresses allocated, exceeding its limit of %d",
+			instance.Spec.Name, poolStatus.AllocatedAddresses, *limit)
+	}
+	r.warn(instance, poolStatus, metallbv1alpha1.ConditionAllocationLimitReached, "MaxAllocations", message)
+}
+
+// checkDualStack warns when dual-stack LoadBalancer services request an
+// address from the pool while it can't provide both IP families.
+func (r *AddressPoolStatusReconciler) checkDualStack(instance *metallbv1alpha1.AddressPool, poolStatus *metallbv1alpha1.AddressPoolStatus,
+	ranges []pool.IPRange, services []corev1.Service) {
+	conflicts := pool.DualStackConflicts(instance.Spec.Name, ranges, services)
+	if len(conflicts) == 0 {
+		meta.RemoveStatusCondition(&poolStatus.Conditions, metallbv1alpha1.ConditionMissingIPFamily)
+		return
+	}
+
+	names := make([]string, 0, len(conflicts))
+	for _, c := range conflicts {
+		names = append(names, c.String())
+	}
+	message := fmt.Sprintf("Pool %s holds a single IP family but is requested by the dual-stack services %s",
+		instance.Spec.Name, strings.Join(names, ", "))
+	r.warn(instance, poolStatus, metallbv1alpha1.ConditionMissingIPFamily, "SingleStackPool", message)
+}
+
+// checkSharingConflicts warns when services request an address from a pool
+// excluded from the automatic assignment while sharing it with services
+// requesting another pool, as MetalLB can't find an address for both.
+func (r *AddressPoolStatusReconciler) checkSharingConflicts(instance *metallbv1alpha1.AddressPool, spec *metallbv1alpha1.AddressPoolSpec,
+	poolStatus *metallbv1alpha1.AddressPoolStatus, services []corev1.Service) {
+	var conflicts []types.NamespacedName
+	if spec.AutoAssign != nil && !*spec.AutoAssign {
+		conflicts = pool.SharingConflicts(instance.Spec.Name, services)
+	}
+	if len(conflicts) == 0 {
+		meta.RemoveStatusCondition(&poolStatus.Conditions, metallbv1alpha1.ConditionSharingConflict)
+		return
+	}
+
+	names := make([]string, 0, len(conflicts))
+	for _, c := range conflicts {
+		names = append(names, c.String())
+	}
+	message := fmt.Sprintf("Services %s request pool %s, which is not auto assigned, but share their address with services requesting another pool",
+		strings.Join(names, ", "), instance.Spec.Name)
+	r.warn(instance, poolStatus, metallbv1alpha1.ConditionSharingConflict, "IncompatibleSharedIP", message)
+}
+
+// checkNodeSubnets warns when the addresses of a layer2 pool are outside of the
+// subnets of the nodes, as the speakers could not announce them. This is best
+// effort, as it relies on the subnets listed in the node annotations: the
+// condition is reported as unknown when no node lists them.
+func (r *AddressPoolStatusReconciler) checkNodeSubnets(instance *metallbv1alpha1.AddressPool, poolStatus *metallbv1alpha1.AddressPoolStatus,
+	ranges []pool.IPRange, nodes []corev1.Node) {
+	var outside []pool.IPRange
+	if instance.Spec.Protocol == "layer2" {
+		subnets := pool.NodeSubnets(nodes)
+		if len(subnets) == 0 {
+			meta.SetStatusCondition(&poolStatus.Conditions, metav1.Condition{
+				Type:   metallbv1alpha1.ConditionOutsideNodeSubnets,
+				Status: metav1.ConditionUnknown,
+				Reason: "NodeSubnetsUnknown",
+				Message: fmt.Sprintf("No node lists its subnets in the %s annotation, the addresses of layer2 pool %s can't be checked",
+					pool.NodeSubnetsAnnotation, instance.Spec.Name),
+			})
+			return
+		}
+		outside = pool.OutsideSubnets(ranges, subnets)
+	}
+	if len(outside) == 0 {
+		meta.RemoveStatusCondition(&poolStatus.Conditions, metallbv1alpha1.ConditionOutsideNodeSubnets)
+		return
+	}
+
+	names := make([]string, 0, len(outside))
+	for _, o := range outside {
+		names = append(names, fmt.Sprintf("%s-%s", o.First, o.Last))
+	}
+	message := fmt.Sprintf("Addresses %s of layer2 pool %s are outside of the subnets of the nodes",
+		strings.Join(names, ", "), instance.Spec.Name)
+	r.warn(instance, poolStatus, metallbv1alpha1.ConditionOutsideNodeSubnets, "UnreachableAddresses", message)
+}
+
+// warn sets the condition on the pool status, emitting a Warning event
+// when the condition is new or its message changed.
+func (r *AddressPoolStatusReconciler) warn(instance *metallbv1alpha1.AddressPool, poolStatus *metallbv1alpha1.AddressPoolStatus,
+	conditionType, reason, message string) {
+	if c := meta.FindStatusCondition(poolStatus.Conditions, conditionType); c == nil || c.Message != message {
+		r.Recorder.Event(instance, corev1.EventTypeWarning, conditionType, message)
+	}
+	meta.SetStatusCondition(&poolStatus.Conditions, metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionTrue,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+// checkUnused reports the pools excluded from the automatic assignment which
+// no LoadBalancer service draws from, as they are likely dead configuration.
+func checkUnused(instance *metallbv1alpha1.AddressPool, spec *metallbv1alpha1.AddressPoolSpec, poolStatus *metallbv1alpha1.AddressPoolStatus,
+	ranges []pool.IPRange, services []corev1.Service) {
+	autoAssign := spec.AutoAssign == nil || *spec.AutoAssign
+	if autoAssign || !pool.IsUnused(instance.Spec.Name, ranges, services) {
+		meta.RemoveStatusCondition(&poolStatus.Conditions, metallbv1alpha1.ConditionUnused)
+		return
+	}
+	meta.SetStatusCondition(&poolStatus.Conditions, metav1.Condition{
+		Type:    metallbv1alpha1.ConditionUnused,
+		Status:  metav1.ConditionTrue,
+		Reason:  "NoServices",
+		Message: fmt.Sprintf("Pool %s is not auto assigned and no LoadBalancer service uses it", instance.Spec.Name),
+	})
+}
+
+// environment returns the environment selected by the Metallb resource of
+// the namespace, or "" when there is none
+func (r *AddressPoolStatusReconciler) environment(ctx context.Context, namespace string) (string, error) {
+	metallb := &metallbv1alpha1.Metallb{}
+	err := r.Get(ctx, types.NamespacedName{Name: defaultMetallbCrName, Namespace: namespace}, metallb)
+	if err != nil {
+		return "", client.IgnoreNotFound(err)
+	}
+	return metallb.Spec.Environment, nil
+}
+
+func (r *AddressPoolStatusReconciler) serviceReader() client.Reader {
+	if r.ClusterCache != nil {
+		return r.ClusterCache
+	}
+	return r.Client
+}
+
+// poolsForService enqueues all the AddressPool objects, as any of them
+// may hold the address assigned to the service, be announced from the node,
+// or be overlaid for the environment selected by the Metallb resource.
+func (r *AddressPoolStatusReconciler) poolsForService(obj client.Object) []reconcile.Request {
+	pools := &metallbv1alpha1.AddressPoolList{}
+	if err := r.List(context.Background(), pools); err != nil {
+		r.Log.Info(fmt.Sprintf("Failed to get existing addresspool objects %s", err))
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(pools.Items))
+	for _, p := range pools.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: p.Namespace, Name: p.Name},
+		})
+	}
+	return requests
+}
+
+func isLoadBalancer(obj client.Object) bool {
+	svc, ok := obj.(*corev1.Service)
+	return ok && svc.Spec.Type == corev1.ServiceTypeLoadBalancer
+}
+
+// loadBalancerPredicate filters the services which are, or stopped being,
+// of type LoadBalancer.
+var loadBalancerPredicate = predicate.Funcs{
+	CreateFunc:  func(e event.CreateEvent) bool { return isLoadBalancer(e.Object) },
+	DeleteFunc:  func(e event.DeleteEvent) bool { return isLoadBalancer(e.Object) },
+	GenericFunc: func(e event.GenericEvent) bool { return isLoadBalancer(e.Object) },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return isLoadBalancer(e.ObjectOld) || isLoadBalancer(e.ObjectNew)
+	},
+}
+
+func (r *AddressPoolStatusReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	var services source.Source = &source.Kind{Type: &corev1.Service{}}
+	var nodes source.Source = &source.Kind{Type: &corev1.Node{}}
+	if r.ClusterCache != nil {
+		services = source.NewKindWithCache(&corev1.Service{}, r.ClusterCache)
+		nodes = source.NewKindWithCache(&corev1.Node{}, r.ClusterCache)
+	}
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("addresspool-status")
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("addresspool-status").
+		For(&metallbv1alpha1.AddressPool{}).
+		Watches(services, handler.EnqueueRequestsFromMapFunc(r.poolsForService),
+			builder.WithPredicates(loadBalancerPredicate)).
+		Watches(nodes, handler.EnqueueRequestsFromMapFunc(r.poolsForService),
+			builder.WithPredicates(predicate.AnnotationChangedPredicate{})).
+		Watches(&source.Kind{Type: &metallbv1alpha1.Metallb{}}, handler.EnqueueRequestsFromMapFunc(r.poolsForService),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
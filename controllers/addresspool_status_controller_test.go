@@ -0,0 +1,446 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/metallb/metallb-operator/api/v1alpha1"
+	"github.com/metallb/metallb-operator/pkg/pool"
+	"github.com/metallb/metallb-operator/test/consts"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("AddressPool Status Controller", func() {
+	Context("utilization", func() {
+		AfterEach(func() {
+			err := k8sClient.DeleteAllOf(context.Background(), &v1alpha1.AddressPool{}, client.InNamespace(consts.MetallbNameSpace))
+			Expect(err).ToNot(HaveOccurred())
+			err = cleanTestServices()
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("Should update the allocated addresses when a LoadBalancer service is created", func() {
+			By("Creating an AddressPool resource")
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "test-addresspool",
+					Protocol:  "layer2",
+					Addresses: []string{"172.20.0.0/24"},
+				},
+			}
+			err := k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Creating a LoadBalancer service with an address of the pool")
+			service := newLoadBalancerService("test-service")
+			err = k8sClient.Create(context.Background(), service)
+			Expect(err).ToNot(HaveOccurred())
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "172.20.0.10"}}
+			err = k8sClient.Status().Update(context.Background(), service)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the utilization of the pool is updated")
+			Eventually(func() int {
+				instance := &v1alpha1.AddressPool{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, instance)
+				if err != nil {
+					return -1
+				}
+				return instance.Status.AllocatedAddresses
+			}, 2*time.Second, 200*time.Millisecond).Should(Equal(1))
+		})
+		It("Should warn when more services request the pool than it can hold", func() {
+			By("Creating a single address AddressPool resource")
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "tiny-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "tiny",
+					Protocol:  "layer2",
+					Addresses: []string{"172.20.0.1/32"},
+				},
+			}
+			err := k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Creating two LoadBalancer services requesting the pool")
+			for _, name := range []string{"test-service1", "test-service2"} {
+				service := newLoadBalancerService(name)
+				service.Annotations = map[string]string{pool.AddressPoolAnnotation: "tiny"}
+				err = k8sClient.Create(context.Background(), service)
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			By("Validating that the pool reports its capacity is exceeded")
+			Eventually(func() *metav1.Condition {
+				instance := &v1alpha1.AddressPool{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, instance)
+				if err != nil {
+					return nil
+				}
+				return meta.FindStatusCondition(instance.Status.Conditions, v1alpha1.ConditionCapacityExceeded)
+			}, 2*time.Second, 200*time.Millisecond).Should(And(
+				Not(BeNil()),
+				WithTransform(func(c *metav1.Condition) string { return c.Message }, ContainSubstring("Pool tiny")),
+			))
+
+			By("Validating that a warning event is emitted")
+			Eventually(func() bool {
+				events := &corev1.EventList{}
+				err := k8sClient.List(context.Background(), events, client.InNamespace(consts.MetallbNameSpace))
+				if err != nil {
+					return false
+				}
+				for _, e := range events.Items {
+					if e.InvolvedObject.Name == addressPool.Name && e.Type == corev1.EventTypeWarning &&
+						e.Reason == v1alpha1.ConditionCapacityExceeded {
+						return true
+					}
+				}
+				return false
+			}, 2*time.Second, 200*time.Millisecond).Should(BeTrue())
+		})
+		It("Should leave the reserved addresses out of the capacity of the pool", func() {
+			By("Creating a two addresses AddressPool resource reserving one of them")
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "reserved-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:             "reserved",
+					Protocol:         "layer2",
+					Addresses:        []string{"172.20.0.0/31"},
+					ReserveAddresses: []string{"172.20.0.0"},
+				},
+			}
+			err := k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Creating two LoadBalancer services requesting the pool")
+			for _, name := range []string{"test-service1", "test-service2"} {
+				service := newLoadBalancerService(name)
+				service.Annotations = map[string]string{pool.AddressPoolAnnotation: "reserved"}
+				err = k8sClient.Create(context.Background(), service)
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			By("Validating that the pool reports its capacity is exceeded")
+			Eventually(func() *metav1.Condition {
+				instance := &v1alpha1.AddressPool{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, instance)
+				if err != nil {
+					return nil
+				}
+				return meta.FindStatusCondition(instance.Status.Conditions, v1alpha1.ConditionCapacityExceeded)
+			}, 2*time.Second, 200*time.Millisecond).Should(And(
+				Not(BeNil()),
+				WithTransform(func(c *metav1.Condition) string { return c.Message }, ContainSubstring("holds 1 addresses")),
+			))
+		})
+		It("Should warn when the allocation limit of the pool is hit", func() {
+			By("Creating an AddressPool resource allowing a single allocation")
+			maxAllocations := 1
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "limited-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:           "limited",
+					Protocol:       "layer2",
+					Addresses:      []string{"172.20.0.0/24"},
+					MaxAllocations: &maxAllocations,
+				},
+			}
+			err := k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			limitCondition := func() *metav1.Condition {
+				instance := &v1alpha1.AddressPool{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, instance)
+				if err != nil {
+					return nil
+				}
+				return meta.FindStatusCondition(instance.Status.Conditions, v1alpha1.ConditionAllocationLimitReached)
+			}
+			Consistently(limitCondition, time.Second, 200*time.Millisecond).Should(BeNil())
+
+			By("Allocating addresses of the pool up to and over the limit")
+			for i, message := range []string{"reaching its limit of 1", "exceeding its limit of 1"} {
+				service := newLoadBalancerService(fmt.Sprintf("test-service%d", i))
+				err = k8sClient.Create(context.Background(), service)
+				Expect(err).ToNot(HaveOccurred())
+				service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: fmt.Sprintf("172.20.0.%d", i+10)}}
+				err = k8sClient.Status().Update(context.Background(), service)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(limitCondition, 2*time.Second, 200*time.Millisecond).Should(And(
+					Not(BeNil()),
+					WithTransform(func(c *metav1.Condition) string { return c.Message }, ContainSubstring(message)),
+				))
+			}
+		})
+		It("Should report an explicit pool no service uses", func() {
+			By("Creating an AddressPool resource excluded from the automatic assignment")
+			autoAssign := false
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "explicit-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:       "explicit",
+					Protocol:   "layer2",
+					Addresses:  []string{"172.30.0.0/24"},
+					AutoAssign: &autoAssign,
+				},
+			}
+			err := k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the pool is reported as unused")
+			Eventually(func() *metav1.Condition {
+				instance := &v1alpha1.AddressPool{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, instance)
+				if err != nil {
+					return nil
+				}
+				return meta.FindStatusCondition(instance.Status.Conditions, v1alpha1.ConditionUnused)
+			}, 2*time.Second, 200*time.Millisecond).ShouldNot(BeNil())
+
+			By("Creating a LoadBalancer service requesting the pool")
+			service := newLoadBalancerService("test-service")
+			service.Annotations = map[string]string{pool.AddressPoolAnnotation: "explicit"}
+			err = k8sClient.Create(context.Background(), service)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the pool is not reported as unused anymore")
+			Eventually(func() *metav1.Condition {
+				instance := &v1alpha1.AddressPool{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, instance)
+				if err != nil {
+					return nil
+				}
+				return meta.FindStatusCondition(instance.Status.Conditions, v1alpha1.ConditionUnused)
+			}, 2*time.Second, 200*time.Millisecond).Should(BeNil())
+		})
+		It("Should check the pool as overlaid for the selected environment", func() {
+			By("Creating a Metallb resource selecting the staging environment")
+			metallb := newTestMetallb()
+			metallb.Spec.Environment = "staging"
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+			defer func() {
+				err := k8sClient.Delete(context.Background(), metallb)
+				Expect(err).ToNot(HaveOccurred())
+				err = cleanTestNamespace()
+				Expect(err).ToNot(HaveOccurred())
+			}()
+
+			By("Creating an AddressPool resource excluded from the automatic assignment in staging")
+			autoAssign := false
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "overlaid-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "overlaid",
+					Protocol:  "layer2",
+					Addresses: []string{"172.30.0.0/24"},
+					Overlays: []v1alpha1.AddressPoolOverlay{
+						{Environment: "staging", Addresses: []string{"172.31.0.0/24"}, AutoAssign: &autoAssign},
+					},
+				},
+			}
+			err = k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the pool is reported as unused")
+			Eventually(func() *metav1.Condition {
+				instance := &v1alpha1.AddressPool{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, instance)
+				if err != nil {
+					return nil
+				}
+				return meta.FindStatusCondition(instance.Status.Conditions, v1alpha1.ConditionUnused)
+			}, 2*time.Second, 200*time.Millisecond).ShouldNot(BeNil())
+
+			By("Creating a LoadBalancer service assigned an address of the staging addresses")
+			service := newLoadBalancerService("test-service")
+			err = k8sClient.Create(context.Background(), service)
+			Expect(err).ToNot(HaveOccurred())
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "172.31.0.10"}}
+			err = k8sClient.Status().Update(context.Background(), service)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the address is counted as allocated")
+			Eventually(func() int {
+				instance := &v1alpha1.AddressPool{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, instance)
+				if err != nil {
+					return -1
+				}
+				return instance.Status.AllocatedAddresses
+			}, 2*time.Second, 200*time.Millisecond).Should(Equal(1))
+		})
+		It("Should warn when services sharing an address request different pools", func() {
+			By("Creating an AddressPool resource excluded from the automatic assignment")
+			autoAssign := false
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "explicit-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:       "explicit",
+					Protocol:   "layer2",
+					Addresses:  []string{"172.30.0.0/24"},
+					AutoAssign: &autoAssign,
+				},
+			}
+			err := k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Creating LoadBalancer services sharing a key but not the pool")
+			service := newLoadBalancerService("test-service1")
+			service.Annotations = map[string]string{pool.AddressPoolAnnotation: "explicit", pool.SharedIPAnnotation: "frontend"}
+			err = k8sClient.Create(context.Background(), service)
+			Expect(err).ToNot(HaveOccurred())
+			service = newLoadBalancerService("test-service2")
+			service.Annotations = map[string]string{pool.SharedIPAnnotation: "frontend"}
+			err = k8sClient.Create(context.Background(), service)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the pool reports the conflict")
+			Eventually(func() *metav1.Condition {
+				instance := &v1alpha1.AddressPool{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, instance)
+				if err != nil {
+					return nil
+				}
+				return meta.FindStatusCondition(instance.Status.Conditions, v1alpha1.ConditionSharingConflict)
+			}, 2*time.Second, 200*time.Millisecond).Should(And(
+				Not(BeNil()),
+				WithTransform(func(c *metav1.Condition) string { return c.Message }, ContainSubstring("default/test-service1")),
+			))
+
+			By("Validating that a warning event naming the service is emitted")
+			Eventually(func() bool {
+				events := &corev1.EventList{}
+				err := k8sClient.List(context.Background(), events, client.InNamespace(consts.MetallbNameSpace))
+				if err != nil {
+					return false
+				}
+				for _, e := range events.Items {
+					if e.InvolvedObject.Name == addressPool.Name && e.Type == corev1.EventTypeWarning &&
+						e.Reason == v1alpha1.ConditionSharingConflict && strings.Contains(e.Message, "default/test-service1") {
+						return true
+					}
+				}
+				return false
+			}, 2*time.Second, 200*time.Millisecond).Should(BeTrue())
+		})
+		It("Should warn when the addresses of a layer2 pool are outside of the node subnets", func() {
+			By("Creating a layer2 AddressPool resource")
+			addressPool := &v1alpha1.AddressPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "layer2-addresspool",
+					Namespace: consts.MetallbNameSpace,
+				},
+				Spec: v1alpha1.AddressPoolSpec{
+					Name:      "layer2",
+					Protocol:  "layer2",
+					Addresses: []string{"172.30.0.0/24"},
+				},
+			}
+			err := k8sClient.Create(context.Background(), addressPool)
+			Expect(err).ToNot(HaveOccurred())
+
+			getCondition := func() *metav1.Condition {
+				instance := &v1alpha1.AddressPool{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: addressPool.Name, Namespace: addressPool.Namespace}, instance)
+				if err != nil {
+					return nil
+				}
+				return meta.FindStatusCondition(instance.Status.Conditions, v1alpha1.ConditionOutsideNodeSubnets)
+			}
+
+			By("Validating that the check is reported as unknown while no node lists its subnets")
+			Eventually(getCondition, 2*time.Second, 200*time.Millisecond).Should(And(
+				Not(BeNil()),
+				WithTransform(func(c *metav1.Condition) metav1.ConditionStatus { return c.Status }, Equal(metav1.ConditionUnknown)),
+			))
+
+			By("Creating a node attached to another subnet")
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-node",
+					Annotations: map[string]string{pool.NodeSubnetsAnnotation: "10.10.0.0/24"},
+				},
+			}
+			err = k8sClient.Create(context.Background(), node)
+			Expect(err).ToNot(HaveOccurred())
+			defer func() {
+				err := k8sClient.Delete(context.Background(), node)
+				Expect(err).ToNot(HaveOccurred())
+			}()
+
+			By("Validating that the pool reports the unreachable addresses")
+			Eventually(getCondition, 2*time.Second, 200*time.Millisecond).Should(And(
+				Not(BeNil()),
+				WithTransform(func(c *metav1.Condition) metav1.ConditionStatus { return c.Status }, Equal(metav1.ConditionTrue)),
+				WithTransform(func(c *metav1.Condition) string { return c.Message }, ContainSubstring("172.30.0.0-172.30.0.255")),
+			))
+		})
+	})
+})
+
+func newLoadBalancerService(name string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{
+				{
+					Port:       80,
+					TargetPort: intstr.FromInt(8080),
+				},
+			},
+		},
+	}
+}
+
+func cleanTestServices() error {
+	services := &corev1.ServiceList{}
+	if err := k8sClient.List(context.Background(), services, client.InNamespace("default")); err != nil {
+		return err
+	}
+	for i := range services.Items {
+		if services.Items[i].Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		if err := k8sClient.Delete(context.Background(), &services.Items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
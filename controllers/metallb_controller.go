@@ -25,6 +25,9 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -32,24 +35,37 @@ import (
 
 	metallbv1alpha1 "github.com/metallb/metallb-operator/api/v1alpha1"
 	"github.com/metallb/metallb-operator/pkg/apply"
+	"github.com/metallb/metallb-operator/pkg/featuregates"
+	"github.com/metallb/metallb-operator/pkg/notify"
 	"github.com/metallb/metallb-operator/pkg/render"
 	"github.com/metallb/metallb-operator/pkg/status"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
-const defaultMetallbCrName = "metallb"
+const (
+	defaultMetallbCrName = "metallb"
+	speakerName          = "speaker"
+)
 
 // MetallbReconciler reconciles a Metallb object
 type MetallbReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+	// FeatureGates enables the optional behaviors the Metallb resource can request
+	FeatureGates featuregates.FeatureGates
+	// Notifier posts the summary of each reconcile, if set
+	Notifier *notify.Notifier
 }
 
 var ManifestPath = "./bindata/deployment"
+var GrafanaDashboardManifestPath = "./bindata/grafana"
+
+const grafanaDashboardName = "metallb-grafana-dashboard"
 
 // Namespace Scoped
 // +kubebuilder:rbac:groups=apps,namespace=metallb-system,resources=deployments;daemonsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",namespace=metallb-system,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 
 // Cluster Scoped
 // +kubebuilder:rbac:groups=metallb.io,resources=metallbs,verbs=get;list;watch;create;update;patch;delete
@@ -82,7 +98,8 @@ func (r *MetallbReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, nil // Return success to avoid requeue
 	}
 
-	result, condition, err := r.reconcileResource(ctx, req, instance)
+	result, condition, changed, err := r.reconcileResource(ctx, req, instance)
+	instance.Status.ConfigSchema = configSchema()
 	if condition != "" {
 		errorMsg, wrappedErrMsg := "", ""
 		if err != nil {
@@ -94,22 +111,60 @@ func (r *MetallbReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 			logger.Info("Failed to update metallb status", "Desired status", status.ConditionAvailable)
 		}
 	}
+	r.Notifier.Notify(reconcileSummary(instance, changed, err))
 	return result, err
 }
 
-func (r *MetallbReconciler) reconcileResource(ctx context.Context, req ctrl.Request, instance *metallbv1alpha1.Metallb) (ctrl.Result, string, error) {
-	err := r.syncMetalLBResources(instance)
+func (r *MetallbReconciler) reconcileResource(ctx context.Context, req ctrl.Request, instance *metallbv1alpha1.Metallb) (ctrl.Result, string, []notify.Object, error) {
+	changed, err := r.syncMetalLBResources(instance)
 	if err != nil {
-		return ctrl.Result{}, status.ConditionDegraded, errors.Wrapf(err, "FailedToSyncMetalLBResources")
+		return ctrl.Result{}, status.ConditionDegraded, changed, errors.Wrapf(err, "FailedToSyncMetalLBResources")
 	}
-	err = status.IsMetallbAvailable(context.TODO(), r.Client, req.NamespacedName.Namespace)
+	err = status.IsMetallbAvailable(context.TODO(), r.Client, req.NamespacedName.Namespace, speakerWorkloadType(instance), instance.Spec.WaitForReadiness)
 	if err != nil {
 		if _, ok := err.(status.MetallbResourcesNotReadyError); ok {
-			return ctrl.Result{RequeueAfter: 5 * time.Second}, status.ConditionProgressing, nil
+			return ctrl.Result{RequeueAfter: 5 * time.Second}, status.ConditionProgressing, changed, nil
 		}
-		return ctrl.Result{}, status.ConditionProgressing, err
+		return ctrl.Result{}, status.ConditionProgressing, changed, err
+	}
+	return ctrl.Result{}, status.ConditionAvailable, changed, nil
+}
+
+// reconcileSummary describes the outcome of the reconcile of the Metallb
+// resource for the external notifications
+func reconcileSummary(instance *metallbv1alpha1.Metallb, changed []notify.Object, err error) notify.Summary {
+	summary := notify.Summary{
+		Kind:       "Metallb",
+		Namespace:  instance.Namespace,
+		Name:       instance.Name,
+		Changed:    changed,
+		Conditions: instance.Status.Conditions,
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// checkFeatureGates rejects the Metallb resources requesting a feature
+// disabled by the feature gates of the operator
+func checkFeatureGates(config *metallbv1alpha1.Metallb, gates featuregates.FeatureGates) error {
+	if config.Spec.EnableGrafanaDashboard && !gates.GrafanaDashboard {
+		return fmt.Errorf("enableGrafanaDashboard is set but the %s feature gate is disabled", featuregates.GrafanaDashboard)
+	}
+	if config.Spec.SecureMetrics && !gates.SecureMetrics {
+		return fmt.Errorf("secureMetrics is set but the %s feature gate is disabled", featuregates.SecureMetrics)
+	}
+	return nil
+}
+
+// configSchema returns the schema of the MetalLB configuration generated
+// from the AddressPool objects.
+func configSchema() metallbv1alpha1.ConfigSchema {
+	return metallbv1alpha1.ConfigSchema{
+		Mode:       metallbv1alpha1.ConfigSchemaModeConfigMap,
+		APIVersion: corev1.SchemeGroupVersion.String(),
 	}
-	return ctrl.Result{}, status.ConditionAvailable, nil
 }
 
 func (r *MetallbReconciler) SetupWithManager(mgr ctrl.Manager) error {
@@ -118,26 +173,177 @@ func (r *MetallbReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Complete(r)
 }
 
-func (r *MetallbReconciler) syncMetalLBResources(config *metallbv1alpha1.Metallb) error {
+// Images returns the images the MetalLB manifests are rendered with,
+// as set by the env variables
+func Images() map[string]string {
+	kubeRBACProxyImage := os.Getenv("KUBE_RBAC_PROXY_IMAGE")
+	if kubeRBACProxyImage == "" {
+		kubeRBACProxyImage = defaultKubeRBACProxyImage
+	}
+	return map[string]string{
+		"SpeakerImage":       os.Getenv("SPEAKER_IMAGE"),
+		"ControllerImage":    os.Getenv("CONTROLLER_IMAGE"),
+		"KubeRBACProxyImage": kubeRBACProxyImage,
+	}
+}
+
+// syncMetalLBResources applies the MetalLB manifests, returning the objects
+// created or updated
+func (r *MetallbReconciler) syncMetalLBResources(config *metallbv1alpha1.Metallb) ([]notify.Object, error) {
 	logger := r.Log.WithName("syncMetalLBResources")
 	logger.Info("Start")
+	if err := checkFeatureGates(config, r.FeatureGates); err != nil {
+		return nil, err
+	}
 	data := render.MakeRenderData()
 
-	data.Data["SpeakerImage"] = os.Getenv("SPEAKER_IMAGE")
-	data.Data["ControllerImage"] = os.Getenv("CONTROLLER_IMAGE")
+	for k, v := range Images() {
+		data.Data[k] = v
+	}
 	objs, err := render.RenderDir(ManifestPath, &data)
 	if err != nil {
 		logger.Error(err, "Fail to render config daemon manifests")
-		return err
+		return nil, err
+	}
+
+	dashboards, err := r.grafanaDashboards(config, &data)
+	if err != nil {
+		return nil, err
+	}
+	objs = append(objs, dashboards...)
+
+	if err := r.setSpeakerWorkload(config, objs); err != nil {
+		return nil, errors.Wrapf(err, "Failed to set the speaker workload")
+	}
+
+	if err := setControllerMetricsBindAddress(config, objs); err != nil {
+		return nil, errors.Wrapf(err, "Failed to set the controller metrics bind address")
 	}
 
+	if err := setSecureMetrics(config, objs, data.Data["KubeRBACProxyImage"].(string)); err != nil {
+		return nil, errors.Wrapf(err, "Failed to secure the controller metrics")
+	}
+
+	if err := setPodSecurityContext(config, objs); err != nil {
+		return nil, errors.Wrapf(err, "Failed to set the pods security context")
+	}
+
+	setSpeakerAnnotations(config, objs)
+
+	if err := r.validateLayer2Capabilities(config, objs); err != nil {
+		return nil, err
+	}
+
+	changed := []notify.Object{}
 	for _, obj := range objs {
 		if err := controllerutil.SetControllerReference(config, obj, r.Scheme); err != nil {
-			return errors.Wrapf(err, "Failed to set controller reference to %s %s", obj.GetNamespace(), obj.GetName())
+			return changed, errors.Wrapf(err, "Failed to set controller reference to %s %s", obj.GetNamespace(), obj.GetName())
 		}
-		if err := apply.ApplyObject(context.TODO(), r.Client, obj); err != nil {
-			return errors.Wrapf(err, "could not apply (%s) %s/%s", obj.GroupVersionKind(), obj.GetNamespace(), obj.GetName())
+		if err := apply.SetManagedPorts(obj); err != nil {
+			return changed, errors.Wrapf(err, "Failed to record the ports of %s %s", obj.GetNamespace(), obj.GetName())
+		}
+		updated, err := apply.ApplyObjectChanged(context.TODO(), r.Client, obj)
+		if err != nil {
+			return changed, errors.Wrapf(err, "could not apply (%s) %s/%s", obj.GroupVersionKind(), obj.GetNamespace(), obj.GetName())
 		}
+		if updated {
+			changed = append(changed, notify.Object{Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()})
+		}
+	}
+	return changed, nil
+}
+
+// validateLayer2Capabilities makes sure the speaker retains the capabilities
+// required to announce the addresses of the layer2 pools
+func (r *MetallbReconciler) validateLayer2Capabilities(config *metallbv1alpha1.Metallb, objs []*unstructured.Unstructured) error {
+	pools := &metallbv1alpha1.AddressPoolList{}
+	if err := r.List(context.TODO(), pools, client.InNamespace(config.Namespace)); err != nil {
+		return errors.Wrapf(err, "Failed to get existing addresspool objects")
+	}
+	for _, p := range pools.Items {
+		if p.Spec.Protocol != "layer2" {
+			continue
+		}
+		if err := checkSpeakerCapabilities(objs); err != nil {
+			return errors.Wrapf(err, "Layer2 addresspool %s can't be announced", p.Spec.Name)
+		}
+		return nil
 	}
 	return nil
 }
+
+// setSpeakerWorkload converts the rendered speaker DaemonSet to the workload type
+// requested in the Metallb resource, and deletes the speaker workload of the
+// other type possibly left by a previous reconcile.
+func (r *MetallbReconciler) setSpeakerWorkload(config *metallbv1alpha1.Metallb, objs []*unstructured.Unstructured) error {
+	for _, obj := range objs {
+		if obj.GetKind() != "DaemonSet" || obj.GetName() != speakerName {
+			continue
+		}
+
+		var stale client.Object = &appsv1.Deployment{}
+		if speakerWorkloadType(config) == metallbv1alpha1.SpeakerWorkloadDeployment {
+			if err := speakerToDeployment(obj); err != nil {
+				return err
+			}
+			stale = &appsv1.DaemonSet{}
+		}
+		stale.SetName(obj.GetName())
+		stale.SetNamespace(obj.GetNamespace())
+		if err := r.deleteIfExists(stale); err != nil {
+			return errors.Wrapf(err, "Failed to delete stale speaker %s", obj.GetName())
+		}
+	}
+	return nil
+}
+
+// speakerToDeployment turns the speaker DaemonSet into a single replica Deployment
+func speakerToDeployment(obj *unstructured.Unstructured) error {
+	obj.SetKind("Deployment")
+	unstructured.RemoveNestedField(obj.Object, "spec", "updateStrategy")
+	if err := unstructured.SetNestedField(obj.Object, int64(1), "spec", "replicas"); err != nil {
+		return err
+	}
+	// The speaker binds host ports, so the old pod must be gone before the new one can start
+	return unstructured.SetNestedField(obj.Object, "Recreate", "spec", "strategy", "type")
+}
+
+func speakerWorkloadType(config *metallbv1alpha1.Metallb) string {
+	if config.Spec.SpeakerWorkloadType == "" {
+		return metallbv1alpha1.SpeakerWorkloadDaemonSet
+	}
+	return config.Spec.SpeakerWorkloadType
+}
+
+// grafanaDashboards renders the Grafana dashboard ConfigMap when enabled in
+// the Metallb resource, and deletes the existing one otherwise.
+func (r *MetallbReconciler) grafanaDashboards(config *metallbv1alpha1.Metallb, data *render.RenderData) ([]*unstructured.Unstructured, error) {
+	if !config.Spec.EnableGrafanaDashboard {
+		dashboard := &corev1.ConfigMap{}
+		dashboard.SetName(grafanaDashboardName)
+		dashboard.SetNamespace(config.Namespace)
+		if err := r.deleteIfExists(dashboard); err != nil {
+			return nil, errors.Wrapf(err, "Failed to delete the Grafana dashboard")
+		}
+		return nil, nil
+	}
+
+	objs, err := render.RenderDir(GrafanaDashboardManifestPath, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to render the Grafana dashboard manifests")
+	}
+	return objs, nil
+}
+
+// deleteIfExists deletes the object if the cache holds it, so that the
+// reconciles don't send a delete request for an object already gone
+func (r *MetallbReconciler) deleteIfExists(obj client.Object) error {
+	err := r.Get(context.TODO(), client.ObjectKeyFromObject(obj), obj)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return client.IgnoreNotFound(r.Delete(context.TODO(), obj))
+}
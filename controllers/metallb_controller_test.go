@@ -6,11 +6,14 @@ import (
 	"time"
 
 	"github.com/metallb/metallb-operator/api/v1alpha1"
+	"github.com/metallb/metallb-operator/pkg/status"
 	"github.com/metallb/metallb-operator/test/consts"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -64,14 +67,274 @@ var _ = Describe("MetalLB Controller", func() {
 			Expect(len(speakerDaemonSet.Spec.Template.Spec.Containers)).To(BeNumerically(">", 0))
 			Expect(speakerDaemonSet.Spec.Template.Spec.Containers[0].Image).To(Equal(speakerImage))
 		})
+		It("Should create the speaker as a deployment in deployment mode", func() {
+			By("Creating a Metallb resource with the deployment speaker workload")
+			metallb := newTestMetallb()
+			metallb.Spec.SpeakerWorkloadType = v1alpha1.SpeakerWorkloadDeployment
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the speaker is a single replica deployment")
+			speakerDeployment := &appsv1.Deployment{}
+			Eventually(func() error {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: consts.MetallbDaemonsetName, Namespace: consts.MetallbNameSpace}, speakerDeployment)
+				return err
+			}, 2*time.Second, 200*time.Millisecond).ShouldNot((HaveOccurred()))
+			Expect(*speakerDeployment.Spec.Replicas).To(Equal(int32(1)))
+			Expect(speakerDeployment.Spec.Strategy.Type).To(Equal(appsv1.RecreateDeploymentStrategyType))
+			Expect(len(speakerDeployment.Spec.Template.Spec.Containers)).To(BeNumerically(">", 0))
+			Expect(speakerDeployment.Spec.Template.Spec.Containers[0].Name).To(Equal("speaker"))
+
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Name: consts.MetallbDaemonsetName, Namespace: consts.MetallbNameSpace}, &appsv1.DaemonSet{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+		It("Should template the controller metrics bind address", func() {
+			By("Creating a Metallb resource with a metrics bind address")
+			metallb := newTestMetallb()
+			metallb.Spec.ControllerMetricsBindAddress = "fc00:f853:ccd:e793::10"
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the address is passed to the controller")
+			controllerDeployment := &appsv1.Deployment{}
+			Eventually(func() error {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: consts.MetallbDeploymentName, Namespace: consts.MetallbNameSpace}, controllerDeployment)
+				return err
+			}, 2*time.Second, 200*time.Millisecond).ShouldNot((HaveOccurred()))
+			Expect(len(controllerDeployment.Spec.Template.Spec.Containers)).To(BeNumerically(">", 0))
+			Expect(controllerDeployment.Spec.Template.Spec.Containers[0].Args).To(ContainElement("--host=fc00:f853:ccd:e793::10"))
+		})
+		It("Should add the kube-rbac-proxy sidecar when securing the metrics", func() {
+			By("Creating a Metallb resource with secure metrics")
+			metallb := newTestMetallb()
+			metallb.Spec.SecureMetrics = true
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the metrics are served by the sidecar")
+			controllerDeployment := &appsv1.Deployment{}
+			Eventually(func() error {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: consts.MetallbDeploymentName, Namespace: consts.MetallbNameSpace}, controllerDeployment)
+				return err
+			}, 2*time.Second, 200*time.Millisecond).ShouldNot((HaveOccurred()))
+			containers := controllerDeployment.Spec.Template.Spec.Containers
+			Expect(containers).To(HaveLen(2))
+			Expect(containers[0].Args).To(ContainElement("--host=127.0.0.1"))
+			Expect(containers[0].Ports).To(BeEmpty())
+			Expect(containers[1].Name).To(Equal("kube-rbac-proxy"))
+			Expect(containers[1].Image).To(Equal(defaultKubeRBACProxyImage))
+			Expect(containers[1].Args).To(ContainElement("--upstream=http://127.0.0.1:7472/"))
+			Expect(containers[1].Ports).To(ConsistOf(corev1.ContainerPort{Name: "monitoring", ContainerPort: 9120, Protocol: corev1.ProtocolTCP}))
+			Expect(controllerDeployment.Spec.Template.Annotations).To(HaveKeyWithValue("prometheus.io/port", "9120"))
+			Expect(controllerDeployment.Spec.Template.Annotations).To(HaveKeyWithValue("prometheus.io/scheme", "https"))
+		})
+		It("Should drop the controller metrics port when securing the metrics of an existing controller", func() {
+			By("Creating a Metallb resource without secure metrics")
+			metallb := newTestMetallb()
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			controllerDeployment := &appsv1.Deployment{}
+			Eventually(func() error {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: consts.MetallbDeploymentName, Namespace: consts.MetallbNameSpace}, controllerDeployment)
+				return err
+			}, 2*time.Second, 200*time.Millisecond).ShouldNot((HaveOccurred()))
+			Expect(controllerDeployment.Spec.Template.Spec.Containers[0].Ports).To(ContainElement(
+				corev1.ContainerPort{Name: "monitoring", ContainerPort: 7472, Protocol: corev1.ProtocolTCP}))
+
+			By("Enabling secure metrics")
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Name: metallb.Name, Namespace: metallb.Namespace}, metallb)
+			Expect(err).ToNot(HaveOccurred())
+			metallb.Spec.SecureMetrics = true
+			err = k8sClient.Update(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that only the sidecar exposes the metrics")
+			Eventually(func() []corev1.Container {
+				controllerDeployment = &appsv1.Deployment{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: consts.MetallbDeploymentName, Namespace: consts.MetallbNameSpace}, controllerDeployment)
+				if err != nil {
+					return nil
+				}
+				return controllerDeployment.Spec.Template.Spec.Containers
+			}, 2*time.Second, 200*time.Millisecond).Should(HaveLen(2))
+			containers := controllerDeployment.Spec.Template.Spec.Containers
+			Expect(containers[0].Ports).To(BeEmpty())
+			Expect(containers[1].Ports).To(ConsistOf(corev1.ContainerPort{Name: "monitoring", ContainerPort: 9120, Protocol: corev1.ProtocolTCP}))
+		})
+		It("Should create the Grafana dashboard when enabled", func() {
+			By("Creating a Metallb resource with the Grafana dashboard enabled")
+			metallb := newTestMetallb()
+			metallb.Spec.EnableGrafanaDashboard = true
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the dashboard ConfigMap is created")
+			dashboard := &corev1.ConfigMap{}
+			Eventually(func() error {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: "metallb-grafana-dashboard", Namespace: consts.MetallbNameSpace}, dashboard)
+				return err
+			}, 2*time.Second, 200*time.Millisecond).ShouldNot((HaveOccurred()))
+			Expect(dashboard.Labels).To(HaveKey("grafana_dashboard"))
+			Expect(dashboard.Data).To(HaveKeyWithValue("metallb.json", ContainSubstring(`"legendFormat": "{{pool}}"`)))
+		})
+		It("Should template the pods security context", func() {
+			By("Creating a Metallb resource with a user and a filesystem group")
+			metallb := newTestMetallb()
+			runAsUser, fsGroup := int64(1001), int64(2000)
+			metallb.Spec.RunAsUser = &runAsUser
+			metallb.Spec.FSGroup = &fsGroup
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the controller pods carry the security context")
+			controllerDeployment := &appsv1.Deployment{}
+			Eventually(func() error {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: consts.MetallbDeploymentName, Namespace: consts.MetallbNameSpace}, controllerDeployment)
+				return err
+			}, 2*time.Second, 200*time.Millisecond).ShouldNot((HaveOccurred()))
+			securityContext := controllerDeployment.Spec.Template.Spec.SecurityContext
+			Expect(securityContext).NotTo(BeNil())
+			Expect(*securityContext.RunAsUser).To(Equal(runAsUser))
+			Expect(*securityContext.FSGroup).To(Equal(fsGroup))
+
+			By("Validating that the speaker pods carry the security context")
+			speakerDaemonSet := &appsv1.DaemonSet{}
+			Eventually(func() error {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: consts.MetallbDaemonsetName, Namespace: consts.MetallbNameSpace}, speakerDaemonSet)
+				return err
+			}, 2*time.Second, 200*time.Millisecond).ShouldNot((HaveOccurred()))
+			securityContext = speakerDaemonSet.Spec.Template.Spec.SecurityContext
+			Expect(securityContext).NotTo(BeNil())
+			Expect(*securityContext.RunAsUser).To(Equal(runAsUser))
+			Expect(*securityContext.FSGroup).To(Equal(fsGroup))
+		})
+		It("Should annotate the speaker daemonset", func() {
+			By("Creating a Metallb resource with speaker annotations")
+			metallb := newTestMetallb()
+			metallb.Spec.SpeakerAnnotations = map[string]string{"argocd.argoproj.io/sync-wave": "2"}
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the annotations are set on the daemonset")
+			speakerAnnotations := func() map[string]string {
+				speakerDaemonSet := &appsv1.DaemonSet{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: consts.MetallbDaemonsetName, Namespace: consts.MetallbNameSpace}, speakerDaemonSet)
+				if err != nil {
+					return nil
+				}
+				return speakerDaemonSet.Annotations
+			}
+			Eventually(speakerAnnotations, 2*time.Second, 200*time.Millisecond).Should(HaveKeyWithValue("argocd.argoproj.io/sync-wave", "2"))
+
+			By("Triggering a new reconcile")
+			instance := &v1alpha1.Metallb{}
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Name: metallb.Name, Namespace: metallb.Namespace}, instance)
+			Expect(err).ToNot(HaveOccurred())
+			instance.Spec.ControllerMetricsBindAddress = "172.20.0.1"
+			err = k8sClient.Update(context.Background(), instance)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the annotations persist")
+			Consistently(speakerAnnotations, time.Second, 200*time.Millisecond).Should(HaveKeyWithValue("argocd.argoproj.io/sync-wave", "2"))
+		})
+		It("Should report Available only once the workloads are ready", func() {
+			By("Creating a Metallb resource waiting for readiness")
+			metallb := newTestMetallb()
+			metallb.Spec.WaitForReadiness = true
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Reporting the speaker pods as ready")
+			speakerDaemonSet := &appsv1.DaemonSet{}
+			Eventually(func() error {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: consts.MetallbDaemonsetName, Namespace: consts.MetallbNameSpace}, speakerDaemonSet)
+				return err
+			}, 2*time.Second, 200*time.Millisecond).ShouldNot((HaveOccurred()))
+			speakerDaemonSet.Status = appsv1.DaemonSetStatus{
+				ObservedGeneration:     speakerDaemonSet.Generation,
+				DesiredNumberScheduled: 1,
+				CurrentNumberScheduled: 1,
+				UpdatedNumberScheduled: 1,
+				NumberReady:            1,
+			}
+			err = k8sClient.Status().Update(context.Background(), speakerDaemonSet)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Reporting a ready controller pod of a previous spec")
+			controllerDeployment := &appsv1.Deployment{}
+			Eventually(func() error {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: consts.MetallbDeploymentName, Namespace: consts.MetallbNameSpace}, controllerDeployment)
+				return err
+			}, 2*time.Second, 200*time.Millisecond).ShouldNot((HaveOccurred()))
+			controllerDeployment.Status = appsv1.DeploymentStatus{
+				ObservedGeneration: controllerDeployment.Generation - 1,
+				Replicas:           1,
+				ReadyReplicas:      1,
+			}
+			err = k8sClient.Status().Update(context.Background(), controllerDeployment)
+			Expect(err).ToNot(HaveOccurred())
+
+			isAvailable := func() bool {
+				instance := &v1alpha1.Metallb{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: metallb.Name, Namespace: metallb.Namespace}, instance)
+				if err != nil {
+					return false
+				}
+				return meta.IsStatusConditionTrue(instance.Status.Conditions, status.ConditionAvailable)
+			}
+			By("Validating that the resource is not Available")
+			Consistently(isAvailable, 6*time.Second, 500*time.Millisecond).Should(BeFalse())
+
+			By("Reporting the controller pod of the current spec as ready")
+			controllerDeployment.Status.ObservedGeneration = controllerDeployment.Generation
+			controllerDeployment.Status.UpdatedReplicas = 1
+			err = k8sClient.Status().Update(context.Background(), controllerDeployment)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the resource becomes Available")
+			Eventually(isAvailable, 10*time.Second, 500*time.Millisecond).Should(BeTrue())
+		})
+		It("Should report the config schema in the status", func() {
+			By("Creating a Metallb resource")
+			metallb := newTestMetallb()
+			err := k8sClient.Create(context.Background(), metallb)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating that the ConfigMap schema is reported")
+			Eventually(func() v1alpha1.ConfigSchema {
+				instance := &v1alpha1.Metallb{}
+				err := k8sClient.Get(context.Background(), types.NamespacedName{Name: metallb.Name, Namespace: metallb.Namespace}, instance)
+				if err != nil {
+					return v1alpha1.ConfigSchema{}
+				}
+				return instance.Status.ConfigSchema
+			}, 2*time.Second, 200*time.Millisecond).Should(Equal(v1alpha1.ConfigSchema{
+				Mode:       v1alpha1.ConfigSchemaModeConfigMap,
+				APIVersion: "v1",
+			}))
+		})
 	})
 })
 
+func newTestMetallb() *v1alpha1.Metallb {
+	return &v1alpha1.Metallb{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "metallb",
+			Namespace: consts.MetallbNameSpace,
+		},
+	}
+}
+
 func cleanTestNamespace() error {
 	err := k8sClient.DeleteAllOf(context.Background(), &appsv1.Deployment{}, client.InNamespace(consts.MetallbNameSpace))
 	if err != nil {
 		return err
 	}
 	err = k8sClient.DeleteAllOf(context.Background(), &appsv1.DaemonSet{}, client.InNamespace(consts.MetallbNameSpace))
+	if err != nil {
+		return err
+	}
+	err = k8sClient.DeleteAllOf(context.Background(), &corev1.ConfigMap{}, client.InNamespace(consts.MetallbNameSpace))
 	return err
 }
@@ -0,0 +1,267 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	metallbv1alpha1 "github.com/metallb/metallb-operator/api/v1alpha1"
+)
+
+const (
+	controllerName            = "controller"
+	kubeRBACProxyName         = "kube-rbac-proxy"
+	defaultKubeRBACProxyImage = "gcr.io/kubebuilder/kube-rbac-proxy:v0.5.0"
+	// controllerMetricsPort is the port the controller serves its metrics on,
+	// as set in the manifests
+	controllerMetricsPort = 7472
+	secureMetricsPort     = 9120
+)
+
+// findObject returns the rendered object with the given kind and name
+func findObject(objs []*unstructured.Unstructured, kind, name string) *unstructured.Unstructured {
+	for _, obj := range objs {
+		if obj.GetKind() == kind && obj.GetName() == name {
+			return obj
+		}
+	}
+	return nil
+}
+
+// findContainer returns the container with the given name of the workload pod template
+func findContainer(obj *unstructured.Unstructured, name string) (map[string]interface{}, error) {
+	containers, _, err := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		if container, ok := c.(map[string]interface{}); ok && container["name"] == name {
+			return container, nil
+		}
+	}
+	return nil, fmt.Errorf("container %s not found in %s %s", name, obj.GetKind(), obj.GetName())
+}
+
+// updateContainer applies update to the container with the given name
+// of the workload pod template
+func updateContainer(obj *unstructured.Unstructured, name string, update func(container map[string]interface{}) error) error {
+	containers, _, err := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		container, ok := c.(map[string]interface{})
+		if !ok || container["name"] != name {
+			continue
+		}
+		if err := update(container); err != nil {
+			return err
+		}
+		return unstructured.SetNestedSlice(obj.Object, containers, "spec", "template", "spec", "containers")
+	}
+	return fmt.Errorf("container %s not found in %s %s", name, obj.GetKind(), obj.GetName())
+}
+
+func appendArgs(container map[string]interface{}, args ...string) error {
+	current, _, err := unstructured.NestedStringSlice(container, "args")
+	if err != nil {
+		return err
+	}
+	return unstructured.SetNestedStringSlice(container, append(current, args...), "args")
+}
+
+// setControllerMetricsBindAddress makes the MetalLB controller expose its
+// metrics on the address requested in the Metallb resource
+func setControllerMetricsBindAddress(config *metallbv1alpha1.Metallb, objs []*unstructured.Unstructured) error {
+	address := config.Spec.ControllerMetricsBindAddress
+	if address == "" {
+		return nil
+	}
+	if net.ParseIP(address) == nil {
+		return fmt.Errorf("invalid controller metrics bind address %q", address)
+	}
+
+	controller := findObject(objs, "Deployment", controllerName)
+	if controller == nil {
+		return fmt.Errorf("controller deployment not found in the manifests")
+	}
+	return updateContainer(controller, controllerName, func(container map[string]interface{}) error {
+		return appendArgs(container, "--host="+address)
+	})
+}
+
+// setPodSecurityContext sets the user and the filesystem group requested in
+// the Metallb resource on the pods of the MetalLB workloads
+func setPodSecurityContext(config *metallbv1alpha1.Metallb, objs []*unstructured.Unstructured) error {
+	if config.Spec.RunAsUser == nil && config.Spec.FSGroup == nil {
+		return nil
+	}
+	for _, obj := range objs {
+		if obj.GetKind() != "Deployment" && obj.GetKind() != "DaemonSet" {
+			continue
+		}
+		if config.Spec.RunAsUser != nil {
+			err := unstructured.SetNestedField(obj.Object, *config.Spec.RunAsUser, "spec", "template", "spec", "securityContext", "runAsUser")
+			if err != nil {
+				return err
+			}
+		}
+		if config.Spec.FSGroup != nil {
+			err := unstructured.SetNestedField(obj.Object, *config.Spec.FSGroup, "spec", "template", "spec", "securityContext", "fsGroup")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// speakerCapabilities are the capabilities the speaker needs to send the
+// gratuitous ARP and NDP messages layer2 mode relies on
+var speakerCapabilities = []string{"NET_RAW", "NET_ADMIN"}
+
+// checkSpeakerCapabilities returns an error if the speaker container lacks
+// any of the speakerCapabilities, unless it is privileged
+func checkSpeakerCapabilities(objs []*unstructured.Unstructured) error {
+	for _, obj := range objs {
+		if obj.GetName() != speakerName || (obj.GetKind() != "DaemonSet" && obj.GetKind() != "Deployment") {
+			continue
+		}
+		container, err := findContainer(obj, speakerName)
+		if err != nil {
+			return err
+		}
+		privileged, _, err := unstructured.NestedBool(container, "securityContext", "privileged")
+		if err != nil {
+			return err
+		}
+		if privileged {
+			return nil
+		}
+		added, _, err := unstructured.NestedStringSlice(container, "securityContext", "capabilities", "add")
+		if err != nil {
+			return err
+		}
+		var missing []string
+		for _, c := range speakerCapabilities {
+			if !hasCapability(added, c) {
+				missing = append(missing, c)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("the speaker container lacks the %s capabilities", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+	return fmt.Errorf("speaker not found in the manifests")
+}
+
+// hasCapability returns true if the added capabilities hold the capability,
+// or all of them
+func hasCapability(added []string, capability string) bool {
+	for _, c := range added {
+		c = strings.TrimPrefix(strings.ToUpper(c), "CAP_")
+		if c == "ALL" || c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// setSpeakerAnnotations adds the annotations requested in the Metallb resource
+// to the speaker workload object. They are kept along with the annotations set
+// by others when merged with the existing object.
+func setSpeakerAnnotations(config *metallbv1alpha1.Metallb, objs []*unstructured.Unstructured) {
+	if len(config.Spec.SpeakerAnnotations) == 0 {
+		return
+	}
+	for _, obj := range objs {
+		if obj.GetName() != speakerName || (obj.GetKind() != "DaemonSet" && obj.GetKind() != "Deployment") {
+			continue
+		}
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		for k, v := range config.Spec.SpeakerAnnotations {
+			annotations[k] = v
+		}
+		obj.SetAnnotations(annotations)
+	}
+}
+
+// setSecureMetrics makes the controller serve its metrics on localhost only,
+// and adds a kube-rbac-proxy sidecar serving them over HTTPS to the
+// scrapers authorized to get them
+func setSecureMetrics(config *metallbv1alpha1.Metallb, objs []*unstructured.Unstructured, image string) error {
+	if !config.Spec.SecureMetrics {
+		return nil
+	}
+	if config.Spec.ControllerMetricsBindAddress != "" {
+		return fmt.Errorf("controllerMetricsBindAddress can't be set along with secureMetrics")
+	}
+
+	controller := findObject(objs, "Deployment", controllerName)
+	if controller == nil {
+		return fmt.Errorf("controller deployment not found in the manifests")
+	}
+	err := updateContainer(controller, controllerName, func(container map[string]interface{}) error {
+		unstructured.RemoveNestedField(container, "ports")
+		return appendArgs(container, "--host=127.0.0.1")
+	})
+	if err != nil {
+		return err
+	}
+
+	containers, _, err := unstructured.NestedSlice(controller.Object, "spec", "template", "spec", "containers")
+	if err != nil {
+		return err
+	}
+	containers = append(containers, map[string]interface{}{
+		"name":  kubeRBACProxyName,
+		"image": image,
+		"args": []interface{}{
+			fmt.Sprintf("--secure-listen-address=0.0.0.0:%d", secureMetricsPort),
+			fmt.Sprintf("--upstream=http://127.0.0.1:%d/", controllerMetricsPort),
+			"--logtostderr=true",
+		},
+		"ports": []interface{}{
+			map[string]interface{}{
+				"containerPort": int64(secureMetricsPort),
+				"name":          "monitoring",
+			},
+		},
+	})
+	if err := unstructured.SetNestedSlice(controller.Object, containers, "spec", "template", "spec", "containers"); err != nil {
+		return err
+	}
+
+	annotations, _, err := unstructured.NestedStringMap(controller.Object, "spec", "template", "metadata", "annotations")
+	if err != nil {
+		return err
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations["prometheus.io/port"] = fmt.Sprint(secureMetricsPort)
+	annotations["prometheus.io/scheme"] = "https"
+	return unstructured.SetNestedStringMap(controller.Object, annotations, "spec", "template", "metadata", "annotations")
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/metallb/metallb-operator/api/v1alpha1"
+	"github.com/metallb/metallb-operator/pkg/featuregates"
+	"github.com/metallb/metallb-operator/pkg/render"
+	"github.com/metallb/metallb-operator/test/consts"
+)
+
+var _ = Describe("MetalLB manifests", func() {
+	Context("checkSpeakerCapabilities", func() {
+		var objs []*unstructured.Unstructured
+		BeforeEach(func() {
+			data := render.MakeRenderData()
+			data.Data["SpeakerImage"] = os.Getenv("SPEAKER_IMAGE")
+			data.Data["ControllerImage"] = os.Getenv("CONTROLLER_IMAGE")
+			var err error
+			objs, err = render.RenderDir(ManifestPath, &data)
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("Should accept the rendered speaker", func() {
+			Expect(checkSpeakerCapabilities(objs)).To(Succeed())
+		})
+		It("Should reject a speaker stripped of NET_RAW", func() {
+			speaker := findObject(objs, "DaemonSet", speakerName)
+			Expect(speaker).NotTo(BeNil())
+			err := updateContainer(speaker, speakerName, func(container map[string]interface{}) error {
+				return unstructured.SetNestedStringSlice(container, []string{"ALL"}, "securityContext", "capabilities", "drop")
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = updateContainer(speaker, speakerName, func(container map[string]interface{}) error {
+				unstructured.RemoveNestedField(container, "securityContext", "capabilities", "add")
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Validating the manifests along with a layer2 pool")
+			err = validateWithLayer2Pool(objs)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("NET_RAW"))
+			Expect(err.Error()).To(ContainSubstring("test-addresspool"))
+		})
+		It("Should reject a speaker stripped of NET_ADMIN", func() {
+			speaker := findObject(objs, "DaemonSet", speakerName)
+			Expect(speaker).NotTo(BeNil())
+			err := updateContainer(speaker, speakerName, func(container map[string]interface{}) error {
+				return unstructured.SetNestedStringSlice(container, []string{"NET_RAW"}, "securityContext", "capabilities", "add")
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = validateWithLayer2Pool(objs)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("NET_ADMIN"))
+			Expect(err.Error()).NotTo(ContainSubstring("NET_RAW"))
+		})
+		It("Should accept a speaker adding all the capabilities or privileged", func() {
+			speaker := findObject(objs, "DaemonSet", speakerName)
+			Expect(speaker).NotTo(BeNil())
+			err := updateContainer(speaker, speakerName, func(container map[string]interface{}) error {
+				return unstructured.SetNestedStringSlice(container, []string{"ALL"}, "securityContext", "capabilities", "add")
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(checkSpeakerCapabilities(objs)).To(Succeed())
+
+			err = updateContainer(speaker, speakerName, func(container map[string]interface{}) error {
+				unstructured.RemoveNestedField(container, "securityContext", "capabilities", "add")
+				return unstructured.SetNestedField(container, true, "securityContext", "privileged")
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(checkSpeakerCapabilities(objs)).To(Succeed())
+		})
+	})
+	Context("checkFeatureGates", func() {
+		It("Should reject the features disabled by the gates", func() {
+			gates, err := featuregates.Parse("SecureMetrics=false")
+			Expect(err).ToNot(HaveOccurred())
+
+			metallb := newTestMetallb()
+			metallb.Spec.EnableGrafanaDashboard = true
+			Expect(checkFeatureGates(metallb, gates)).To(Succeed())
+
+			metallb.Spec.SecureMetrics = true
+			err = checkFeatureGates(metallb, gates)
+			Expect(err).To(MatchError(ContainSubstring("SecureMetrics feature gate is disabled")))
+		})
+	})
+})
+
+// validateWithLayer2Pool validates the capabilities of the speaker of the
+// manifests along with a layer2 pool
+func validateWithLayer2Pool(objs []*unstructured.Unstructured) error {
+	testScheme := runtime.NewScheme()
+	Expect(v1alpha1.AddToScheme(testScheme)).To(Succeed())
+	addressPool := &v1alpha1.AddressPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-addresspool",
+			Namespace: consts.MetallbNameSpace,
+		},
+		Spec: v1alpha1.AddressPoolSpec{
+			Name:      "test-addresspool",
+			Protocol:  "layer2",
+			Addresses: []string{"172.20.0.0/24"},
+		},
+	}
+	r := &MetallbReconciler{Client: fake.NewFakeClientWithScheme(testScheme, addressPool)}
+	return r.validateLayer2Capabilities(newTestMetallb(), objs)
+}
@@ -36,6 +36,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	metallbv1alpha1 "github.com/metallb/metallb-operator/api/v1alpha1"
+	"github.com/metallb/metallb-operator/pkg/featuregates"
 	"github.com/metallb/metallb-operator/test/consts"
 	// +kubebuilder:scaffold:imports
 )
@@ -93,11 +94,28 @@ var _ = BeforeSuite(func() {
 	Expect(err).ToNot(HaveOccurred())
 
 	ManifestPath = strings.Replace(ManifestPath, ".", "..", 1) // This is needed as the tests need to reference a directory backward
+	GrafanaDashboardManifestPath = strings.Replace(GrafanaDashboardManifestPath, ".", "..", 1)
+	AddressPoolManifestPath = strings.Replace(AddressPoolManifestPath, ".", "..", 1)
 
 	err = (&MetallbReconciler{
+		Client:       k8sClient,
+		Scheme:       scheme.Scheme,
+		Log:          ctrl.Log.WithName("controllers").WithName("MetalLB"),
+		FeatureGates: featuregates.Defaults(),
+	}).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = (&AddressPoolReconciler{
+		Client: k8sClient,
+		Scheme: scheme.Scheme,
+		Log:    ctrl.Log.WithName("controllers").WithName("AddressPool"),
+	}).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = (&AddressPoolStatusReconciler{
 		Client: k8sClient,
 		Scheme: scheme.Scheme,
-		Log:    ctrl.Log.WithName("controllers").WithName("MetalLB"),
+		Log:    ctrl.Log.WithName("controllers").WithName("AddressPoolStatus"),
 	}).SetupWithManager(k8sManager)
 	Expect(err).ToNot(HaveOccurred())
 
@@ -17,9 +17,16 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-logr/logr"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -30,10 +37,18 @@ import (
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	metallbv1alpha1 "github.com/metallb/metallb-operator/api/v1alpha1"
 	"github.com/metallb/metallb-operator/controllers"
+	"github.com/metallb/metallb-operator/pkg/certs"
+	"github.com/metallb/metallb-operator/pkg/featuregates"
+	"github.com/metallb/metallb-operator/pkg/notify"
+	"github.com/metallb/metallb-operator/pkg/webhooks"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -42,6 +57,11 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+const (
+	defaultWebhookServiceName = "metallboperator-webhook-service"
+	selfSignedCertSecretName  = "metallboperator-webhook-self-signed-cert"
+)
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
@@ -57,47 +77,130 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var maxConcurrentReconciles int
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 0,
+		"The maximum number of AddressPool objects reconciled in parallel. "+
+			"Defaults to the MAX_CONCURRENT_RECONCILES env variable, or 1 if not set.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
+	if maxConcurrentReconciles == 0 {
+		var err error
+		maxConcurrentReconciles, err = envInt("MAX_CONCURRENT_RECONCILES", 1)
+		if err != nil {
+			setupLog.Error(err, "invalid env variable", "name", "MAX_CONCURRENT_RECONCILES")
+			os.Exit(1)
+		}
+	}
+
 	watchNamepace := checkEnvVar("WATCH_NAMESPACE")
 	checkEnvVar("SPEAKER_IMAGE")
 	checkEnvVar("CONTROLLER_IMAGE")
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	options := ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
 		Port:               9443,
 		LeaderElection:     enableLeaderElection,
 		LeaderElectionID:   "metallb.io.metallboperator",
 		Namespace:          watchNamepace,
-	})
+	}
+	if err := setLeaderElectionDurations(&options); err != nil {
+		setupLog.Error(err, "invalid leader election durations")
+		os.Exit(1)
+	}
+
+	featureGates, err := featuregates.Parse(os.Getenv("FEATURE_GATES"))
+	if err != nil {
+		setupLog.Error(err, "invalid env variable", "name", "FEATURE_GATES")
+		os.Exit(1)
+	}
+
+	enableWebhooks := os.Getenv("ENABLE_WEBHOOKS") == "true"
+	selfSignedCerts := enableWebhooks && os.Getenv("SELF_SIGNED_WEBHOOK_CERTS") == "true"
+	if selfSignedCerts {
+		// The cert-manager certificate directory is a read only mount
+		options.CertDir = filepath.Join(os.TempDir(), "metallb-operator", "serving-certs")
+	}
+	logStartupSummary(setupLog, options, maxConcurrentReconciles, enableWebhooks, featureGates)
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	var notifier *notify.Notifier
+	if url := os.Getenv("NOTIFY_WEBHOOK_URL"); url != "" {
+		notifier = notify.New(url, ctrl.Log.WithName("notify"))
+	}
 	if err = (&controllers.MetallbReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("Metallb"),
-		Scheme: mgr.GetScheme(),
+		Client:       mgr.GetClient(),
+		Log:          ctrl.Log.WithName("controllers").WithName("Metallb"),
+		Scheme:       mgr.GetScheme(),
+		FeatureGates: featureGates,
+		Notifier:     notifier,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Metallb")
 		os.Exit(1)
 	}
 	if err = (&controllers.AddressPoolReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("AddressPool"),
-		Scheme: mgr.GetScheme(),
+		Client:                  mgr.GetClient(),
+		Log:                     ctrl.Log.WithName("controllers").WithName("AddressPool"),
+		Scheme:                  mgr.GetScheme(),
+		MaxConcurrentReconciles: maxConcurrentReconciles,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "AddressPool")
 		os.Exit(1)
 	}
+	// The manager cache is restricted to the operator namespace, while
+	// LoadBalancer services live in the namespaces of the applications and the
+	// nodes are cluster scoped
+	clusterCache, err := cache.New(mgr.GetConfig(), cache.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+	if err != nil {
+		setupLog.Error(err, "unable to create cluster cache")
+		os.Exit(1)
+	}
+	if err = mgr.Add(clusterCache); err != nil {
+		setupLog.Error(err, "unable to add cluster cache")
+		os.Exit(1)
+	}
+	if err = (&controllers.AddressPoolStatusReconciler{
+		Client:       mgr.GetClient(),
+		Log:          ctrl.Log.WithName("controllers").WithName("AddressPoolStatus"),
+		Scheme:       mgr.GetScheme(),
+		ClusterCache: clusterCache,
+		Recorder:     mgr.GetEventRecorderFor("addresspool-status"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "AddressPoolStatus")
+		os.Exit(1)
+	}
+	if selfSignedCerts {
+		if err = setupCertRotator(mgr, watchNamepace, options.CertDir); err != nil {
+			setupLog.Error(err, "unable to set up the self-signed webhook certificate")
+			os.Exit(1)
+		}
+	}
+	if enableWebhooks {
+		if err = (&metallbv1alpha1.AddressPool{}).SetupWebhookWithManager(mgr, clusterCache); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "AddressPool")
+			os.Exit(1)
+		}
+		if err = (&metallbv1alpha1.Metallb{}).SetupWebhookWithManager(mgr, envList("ALLOWED_IMAGE_REGISTRIES")); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Metallb")
+			os.Exit(1)
+		}
+		var serviceHandler admission.Handler = webhooks.ServiceAllower{}
+		if featureGates.DefaultAddressPools {
+			serviceHandler = &webhooks.ServiceDefaulter{Client: mgr.GetClient(), Namespace: watchNamepace}
+		}
+		mgr.GetWebhookServer().Register(webhooks.ServiceDefaulterPath, &webhook.Admission{Handler: serviceHandler})
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -107,6 +210,48 @@ func main() {
 	}
 }
 
+// logStartupSummary logs the effective configuration the operator runs with
+func logStartupSummary(log logr.Logger, options ctrl.Options, maxConcurrentReconciles int, enableWebhooks bool,
+	featureGates featuregates.FeatureGates) {
+	images := controllers.Images()
+	log.Info("startup summary",
+		"speakerImage", images["SpeakerImage"],
+		"controllerImage", images["ControllerImage"],
+		"configMode", metallbv1alpha1.ConfigSchemaModeConfigMap,
+		"watchNamespace", options.Namespace,
+		"leaderElection", options.LeaderElection,
+		"maxConcurrentReconciles", maxConcurrentReconciles,
+		"webhooks", enableWebhooks,
+		"featureGates", featureGates.String())
+}
+
+// setupCertRotator generates the self-signed webhook certificate, and adds
+// the rotator renewing it to the manager
+func setupCertRotator(mgr ctrl.Manager, namespace, certDir string) error {
+	// The manager client can't be used before the manager starts,
+	// while the webhook server needs the certificate to start
+	c, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+	if err != nil {
+		return err
+	}
+	serviceName := os.Getenv("WEBHOOK_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = defaultWebhookServiceName
+	}
+	rotator := &certs.Rotator{
+		Client:      c,
+		Log:         ctrl.Log.WithName("certs"),
+		Namespace:   namespace,
+		SecretName:  selfSignedCertSecretName,
+		ServiceName: serviceName,
+		CertDir:     certDir,
+	}
+	if err := rotator.Ensure(context.Background()); err != nil {
+		return err
+	}
+	return mgr.Add(rotator)
+}
+
 func checkEnvVar(name string) string {
 	value, isSet := os.LookupEnv(name)
 	if !isSet {
@@ -115,3 +260,56 @@ func checkEnvVar(name string) string {
 	}
 	return value
 }
+
+// envInt returns the value of the env variable as an integer,
+// or fallback if the variable is not set.
+func envInt(name string, fallback int) (int, error) {
+	value, isSet := os.LookupEnv(name)
+	if !isSet || value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// envList returns the comma separated values of the env variable,
+// or nil if the variable is not set.
+func envList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// envDuration returns the value of the env variable as a duration,
+// or nil if the variable is not set.
+func envDuration(name string) (*time.Duration, error) {
+	value, isSet := os.LookupEnv(name)
+	if !isSet || value == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return &d, nil
+}
+
+// setLeaderElectionDurations sets the leader election lease durations from
+// the LEASE_DURATION, RENEW_DEADLINE and RETRY_PERIOD env variables.
+// The manager defaults are kept for the variables not set.
+func setLeaderElectionDurations(options *ctrl.Options) error {
+	var err error
+	if options.LeaseDuration, err = envDuration("LEASE_DURATION"); err != nil {
+		return err
+	}
+	if options.RenewDeadline, err = envDuration("RENEW_DEADLINE"); err != nil {
+		return err
+	}
+	if options.RetryPeriod, err = envDuration("RETRY_PERIOD"); err != nil {
+		return err
+	}
+	return nil
+}
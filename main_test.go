@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/metallb/metallb-operator/controllers"
+	"github.com/metallb/metallb-operator/pkg/featuregates"
+)
+
+func TestEnvInt(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer os.Unsetenv("MAX_CONCURRENT_RECONCILES")
+
+	value, err := envInt("MAX_CONCURRENT_RECONCILES", 1)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(value).To(Equal(1))
+
+	os.Setenv("MAX_CONCURRENT_RECONCILES", "4")
+	value, err = envInt("MAX_CONCURRENT_RECONCILES", 1)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(value).To(Equal(4))
+
+	os.Setenv("MAX_CONCURRENT_RECONCILES", "four")
+	_, err = envInt("MAX_CONCURRENT_RECONCILES", 1)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestMaxConcurrentReconciles(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer os.Unsetenv("MAX_CONCURRENT_RECONCILES")
+
+	os.Setenv("MAX_CONCURRENT_RECONCILES", "4")
+	maxConcurrentReconciles, err := envInt("MAX_CONCURRENT_RECONCILES", 1)
+	g.Expect(err).NotTo(HaveOccurred())
+	reconciler := &controllers.AddressPoolReconciler{MaxConcurrentReconciles: maxConcurrentReconciles}
+	g.Expect(reconciler.ControllerOptions().MaxConcurrentReconciles).To(Equal(4))
+}
+
+func TestEnvList(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer os.Unsetenv("ALLOWED_IMAGE_REGISTRIES")
+
+	g.Expect(envList("ALLOWED_IMAGE_REGISTRIES")).To(BeEmpty())
+
+	os.Setenv("ALLOWED_IMAGE_REGISTRIES", "quay.io/metallb, registry.example.com,")
+	g.Expect(envList("ALLOWED_IMAGE_REGISTRIES")).To(Equal([]string{"quay.io/metallb", "registry.example.com"}))
+}
+
+func TestSetLeaderElectionDurations(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer os.Unsetenv("LEASE_DURATION")
+	defer os.Unsetenv("RENEW_DEADLINE")
+	defer os.Unsetenv("RETRY_PERIOD")
+
+	options := ctrl.Options{}
+	g.Expect(setLeaderElectionDurations(&options)).To(Succeed())
+	g.Expect(options.LeaseDuration).To(BeNil())
+	g.Expect(options.RenewDeadline).To(BeNil())
+	g.Expect(options.RetryPeriod).To(BeNil())
+
+	os.Setenv("LEASE_DURATION", "60s")
+	os.Setenv("RENEW_DEADLINE", "40s")
+	os.Setenv("RETRY_PERIOD", "5s")
+	g.Expect(setLeaderElectionDurations(&options)).To(Succeed())
+	g.Expect(*options.LeaseDuration).To(Equal(60 * time.Second))
+	g.Expect(*options.RenewDeadline).To(Equal(40 * time.Second))
+	g.Expect(*options.RetryPeriod).To(Equal(5 * time.Second))
+
+	os.Setenv("RETRY_PERIOD", "often")
+	g.Expect(setLeaderElectionDurations(&options)).NotTo(Succeed())
+}
+
+func TestLogStartupSummary(t *testing.T) {
+	g := NewGomegaWithT(t)
+	defer os.Unsetenv("SPEAKER_IMAGE")
+	defer os.Unsetenv("CONTROLLER_IMAGE")
+
+	os.Setenv("SPEAKER_IMAGE", "quay.io/test/speaker:v1")
+	os.Setenv("CONTROLLER_IMAGE", "quay.io/test/controller:v1")
+
+	out := &bytes.Buffer{}
+	logStartupSummary(zap.New(zap.WriteTo(out)), ctrl.Options{Namespace: "metallb-system"}, 2, true, featuregates.Defaults())
+
+	g.Expect(out.String()).To(ContainSubstring(`"speakerImage":"quay.io/test/speaker:v1"`))
+	g.Expect(out.String()).To(ContainSubstring(`"controllerImage":"quay.io/test/controller:v1"`))
+	g.Expect(out.String()).To(ContainSubstring(`"maxConcurrentReconciles":2`))
+	g.Expect(out.String()).To(ContainSubstring(`"featureGates":"DefaultAddressPools=true,GrafanaDashboard=true,SecureMetrics=true"`))
+}
@@ -14,8 +14,9 @@ import (
 	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// Find existing object or create if if it doesn't exists
-func findOrCreateObject(ctx context.Context, client k8sclient.Client, obj *uns.Unstructured) (*uns.Unstructured, string, error) {
+// Find existing object or create if if it doesn't exists.
+// The placeholders of the object are resolved by secrets before it is created.
+func findOrCreateObject(ctx context.Context, client k8sclient.Client, obj *uns.Unstructured, secrets *SecretResolver) (*uns.Unstructured, string, error) {
 	name := obj.GetName()
 	namespace := obj.GetNamespace()
 	if name == "" {
@@ -37,11 +38,15 @@ func findOrCreateObject(ctx context.Context, client k8sclient.Client, obj *uns.U
 
 	if err != nil && apierrors.IsNotFound(err) {
 		log.Printf("does not exist, creating %s", objDesc)
+		if err := secrets.Resolve(ctx, obj); err != nil {
+			return nil, objDesc, errors.Wrapf(err, "could not resolve the secrets of %s", objDesc)
+		}
 		err := client.Create(ctx, obj)
 		if err != nil {
 			return nil, objDesc, errors.Wrapf(err, "could not create %s", objDesc)
 		}
 		log.Printf("successfully created %s", objDesc)
+		countConfigWrite(obj, false)
 		return obj, objDesc, nil
 	}
 
@@ -51,29 +56,92 @@ func findOrCreateObject(ctx context.Context, client k8sclient.Client, obj *uns.U
 // ApplyObject applies the desired object against the apiserver,
 // merging it with any existing objects if already present.
 func ApplyObject(ctx context.Context, client k8sclient.Client, obj *uns.Unstructured) error {
+	_, err := ApplyObjectChanged(ctx, client, obj)
+	return err
+}
+
+// ApplyObjectChanged applies the desired object like ApplyObject,
+// and returns true if the object was created or updated.
+func ApplyObjectChanged(ctx context.Context, client k8sclient.Client, obj *uns.Unstructured) (bool, error) {
+	return applyObject(ctx, client, obj, nil)
+}
 
-	existing, objDesc, err := findOrCreateObject(ctx, client, obj)
+// ApplyConfigMap applies the config ConfigMap like ApplyObjectChanged,
+// resolving the placeholders of the config once merged with the existing one
+// so that the placeholders of the sections kept from it are resolved too.
+// It returns true if the ConfigMap was created or updated.
+func ApplyConfigMap(ctx context.Context, client k8sclient.Client, obj *uns.Unstructured, secrets *SecretResolver) (bool, error) {
+	return applyObject(ctx, client, obj, secrets)
+}
+
+func applyObject(ctx context.Context, client k8sclient.Client, obj *uns.Unstructured, secrets *SecretResolver) (bool, error) {
+
+	existing, objDesc, err := findOrCreateObject(ctx, client, obj, secrets)
 
 	if existing == nil {
-		return nil
+		return false, nil
 	}
 
 	if err != nil {
-		return errors.Wrapf(err, "could not retrieve existing %s", objDesc)
+		return false, errors.Wrapf(err, "could not retrieve existing %s", objDesc)
+	}
+	if existing == obj {
+		// The object was just created
+		return true, nil
 	}
 
 	// Merge the desired object with what actually exists
 	if err := MergeObjectForUpdate(existing, obj); err != nil {
-		return errors.Wrapf(err, "could not merge object %s with existing", objDesc)
+		return false, errors.Wrapf(err, "could not merge object %s with existing", objDesc)
 	}
-	if !equality.Semantic.DeepEqual(existing, obj) {
-		if err := client.Update(ctx, obj); err != nil {
-			return errors.Wrapf(err, "could not update object %s", objDesc)
-		} else {
-			log.Printf("update was successful")
-		}
+	if err := secrets.Resolve(ctx, obj); err != nil {
+		return false, errors.Wrapf(err, "could not resolve the secrets of %s", objDesc)
+	}
+	if equality.Semantic.DeepEqual(existing, obj) {
+		countConfigWrite(obj, true)
+		return false, nil
 	}
+	if err := client.Update(ctx, obj); err != nil {
+		return false, errors.Wrapf(err, "could not update object %s", objDesc)
+	}
+	log.Printf("update was successful")
+	countConfigWrite(obj, false)
+
+	return true, nil
+}
 
+// RemoveConfigPools removes the pools generated from the AddressPool source,
+// named namespace/name, from the config ConfigMap of the namespace, along with
+// the pools named poolName without source comment when it is not empty. The
+// ConfigMap is only updated when it holds such a pool, the other sections of
+// the config being kept and its placeholders resolved again by secrets.
+func RemoveConfigPools(ctx context.Context, client k8sclient.Client, namespace, source, poolName string, secrets *SecretResolver) error {
+	obj := &uns.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	err := client.Get(ctx, types.NamespacedName{Name: AddressPoolConfigMap, Namespace: namespace}, obj)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not retrieve existing ConfigMap %s/%s", namespace, AddressPoolConfigMap)
+	}
+
+	removed, err := removeConfigPools(obj, source, poolName)
+	if err != nil {
+		return errors.Wrapf(err, "could not remove the pools of %s from the config", source)
+	}
+	if !removed {
+		return nil
+	}
+	if err := secrets.Resolve(ctx, obj); err != nil {
+		return errors.Wrapf(err, "could not resolve the secrets of ConfigMap %s/%s", namespace, AddressPoolConfigMap)
+	}
+	if err := client.Update(ctx, obj); err != nil {
+		return errors.Wrapf(err, "could not update ConfigMap %s/%s", namespace, AddressPoolConfigMap)
+	}
+	log.Printf("removed the pools of %s from the config", source)
+	countConfigWrite(obj, false)
 	return nil
 }
 
@@ -84,7 +152,7 @@ func ApplyObjects(ctx context.Context, client k8sclient.Client, objs []*uns.Unst
 	var objDesc string = ""
 	var err error = nil
 
-	existing, objDesc, err = findOrCreateObject(ctx, client, objs[0])
+	existing, objDesc, err = findOrCreateObject(ctx, client, objs[0], nil)
 	if existing == nil {
 		return nil
 	}
@@ -102,13 +170,18 @@ func ApplyObjects(ctx context.Context, client k8sclient.Client, objs []*uns.Unst
 		lastObj = obj
 	}
 
-	if !equality.Semantic.DeepEqual(existing, lastObj) && lastObj != nil {
-		if err := client.Update(ctx, lastObj); err != nil {
-			return errors.Wrapf(err, "could not update object %s", objDesc)
-		} else {
-			log.Printf("update was successful")
-		}
+	if lastObj == nil || lastObj == existing {
+		return nil
+	}
+	if equality.Semantic.DeepEqual(existing, lastObj) {
+		countConfigWrite(lastObj, true)
+		return nil
+	}
+	if err := client.Update(ctx, lastObj); err != nil {
+		return errors.Wrapf(err, "could not update object %s", objDesc)
 	}
+	log.Printf("update was successful")
+	countConfigWrite(lastObj, false)
 
 	return nil
 }
@@ -0,0 +1,211 @@
+package apply
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	uns "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const testConfigMap = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+      # AddressPool metallb-system/gold
+      - name: gold
+        protocol: layer2
+        addresses:
+          - 172.20.0.100/24
+`
+
+// noPoolsConfigMap is merged with the existing config without changing it
+const noPoolsConfigMap = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools: []
+`
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	metric := &dto.Metric{}
+	if err := counter.Write(metric); err != nil {
+		t.Fatalf("failed to read counter: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestApplyObjectCountsConfigWrites(t *testing.T) {
+	g := NewGomegaWithT(t)
+	client := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	writes := counterValue(t, configWrites)
+	skipped := counterValue(t, configWritesSkipped)
+
+	err := ApplyObject(context.Background(), client, UnstructuredFromYaml(t, testConfigMap))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(counterValue(t, configWrites)).To(Equal(writes + 1))
+	g.Expect(counterValue(t, configWritesSkipped)).To(Equal(skipped))
+
+	// Applying the same pool again doesn't write the ConfigMap
+	err = ApplyObject(context.Background(), client, UnstructuredFromYaml(t, testConfigMap))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(counterValue(t, configWrites)).To(Equal(writes + 1))
+	g.Expect(counterValue(t, configWritesSkipped)).To(Equal(skipped + 1))
+
+	err = ApplyObjects(context.Background(), client, []*uns.Unstructured{
+		UnstructuredFromYaml(t, testConfigMap), UnstructuredFromYaml(t, testConfigMap),
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(counterValue(t, configWrites)).To(Equal(writes + 1))
+	g.Expect(counterValue(t, configWritesSkipped)).To(Equal(skipped + 2))
+}
+
+func TestApplyObjectIgnoresOtherObjects(t *testing.T) {
+	g := NewGomegaWithT(t)
+	client := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	writes := counterValue(t, configWrites)
+
+	err := ApplyObject(context.Background(), client, UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: controller
+  namespace: metallb-system`))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(counterValue(t, configWrites)).To(Equal(writes))
+}
+
+func TestRemoveConfigPools(t *testing.T) {
+	g := NewGomegaWithT(t)
+	client := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+
+	// There is nothing to remove without a config
+	err := RemoveConfigPools(context.Background(), client, "metallb-system", "metallb-system/gold", "", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	err = client.Create(context.Background(), UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    peers:
+    - peer-address: 10.0.0.1
+      peer-asn: 64501
+      my-asn: 64500
+    address-pools:
+    # AddressPool metallb-system/gold
+    - name: gold
+      protocol: bgp
+      addresses:
+      - 172.20.0.100/24
+    # AddressPool metallb-system/silver
+    - name: silver
+      protocol: bgp
+      addresses:
+      - 172.22.0.100/24`))
+	g.Expect(err).ToNot(HaveOccurred())
+	writes := counterValue(t, configWrites)
+
+	config := func() string {
+		obj := UnstructuredFromYaml(t, noPoolsConfigMap)
+		err := client.Get(context.Background(), k8sclient.ObjectKeyFromObject(obj), obj)
+		g.Expect(err).ToNot(HaveOccurred())
+		data, _, err := uns.NestedString(obj.Object, "data", AddressPoolConfigMap)
+		g.Expect(err).ToNot(HaveOccurred())
+		return data
+	}
+
+	// The ConfigMap is not written when it doesn't hold the pool
+	err = RemoveConfigPools(context.Background(), client, "metallb-system", "metallb-system/bronze", "", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(counterValue(t, configWrites)).To(Equal(writes))
+
+	err = RemoveConfigPools(context.Background(), client, "metallb-system", "metallb-system/gold", "", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(counterValue(t, configWrites)).To(Equal(writes + 1))
+	g.Expect(config()).Should(MatchYAML(`peers:
+- peer-address: 10.0.0.1
+  peer-asn: 64501
+  my-asn: 64500
+address-pools:
+- name: silver
+  protocol: bgp
+  addresses:
+  - 172.22.0.100/24
+`))
+
+	// The other sections are kept once the last pool is removed
+	err = RemoveConfigPools(context.Background(), client, "metallb-system", "metallb-system/silver", "", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(config()).Should(MatchYAML(`peers:
+- peer-address: 10.0.0.1
+  peer-asn: 64501
+  my-asn: 64500
+address-pools: []
+`))
+}
+
+func TestRemoveConfigPoolsWithoutSourceComment(t *testing.T) {
+	g := NewGomegaWithT(t)
+	client := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+
+	// The pools written before the source comments were added have none
+	err := client.Create(context.Background(), UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: gold
+      protocol: layer2
+      addresses:
+      - 172.20.0.100/24
+    - name: manual
+      protocol: layer2
+      addresses:
+      - 172.21.0.100/24`))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// Without the name of the pool, only the source comment can match
+	err = RemoveConfigPools(context.Background(), client, "metallb-system", "metallb-system/gold-addresspool", "", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	obj := UnstructuredFromYaml(t, noPoolsConfigMap)
+	err = client.Get(context.Background(), k8sclient.ObjectKeyFromObject(obj), obj)
+	g.Expect(err).ToNot(HaveOccurred())
+	data, _, err := uns.NestedString(obj.Object, "data", AddressPoolConfigMap)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(data).To(ContainSubstring("name: gold"))
+
+	err = RemoveConfigPools(context.Background(), client, "metallb-system", "metallb-system/gold-addresspool", "gold", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	err = client.Get(context.Background(), k8sclient.ObjectKeyFromObject(obj), obj)
+	g.Expect(err).ToNot(HaveOccurred())
+	data, _, err = uns.NestedString(obj.Object, "data", AddressPoolConfigMap)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(data).Should(MatchYAML(`address-pools:
+- name: manual
+  protocol: layer2
+  addresses:
+  - 172.21.0.100/24
+`))
+}
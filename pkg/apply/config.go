@@ -0,0 +1,321 @@
+package apply
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	metallbv1alpha "github.com/metallb/metallb-operator/api/v1alpha1"
+	"github.com/metallb/metallb-operator/pkg/pool"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	uns "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// ConfigIndentAnnotation records the indentation width the MetalLB
+	// config of the ConfigMap is written with
+	ConfigIndentAnnotation = "metallb.io/config-indent"
+	// DefaultConfigIndent is the indentation width used when not configured
+	DefaultConfigIndent = 2
+	// SortAddressesAnnotation records whether the addresses of each pool of
+	// the MetalLB config of the ConfigMap are sorted
+	SortAddressesAnnotation = "metallb.io/sort-addresses"
+)
+
+// configData is the MetalLB config held by the config ConfigMap.
+// Only the address pools are generated by the operator, the other
+// sections are kept as found in the existing ConfigMap.
+type configData struct {
+	Peers          []map[string]interface{} `yaml:"peers,omitempty"`
+	BGPCommunities map[string]string        `yaml:"bgp-communities,omitempty"`
+	AddressPools   []configPool             `yaml:"address-pools"`
+}
+
+// configPool is an address pool of the MetalLB config. It covers all the
+// settings MetalLB supports, not only the ones generated from the AddressPool
+// objects, as the pools of the existing ConfigMap are kept as found.
+type configPool struct {
+	Name              string             `yaml:"name"`
+	Protocol          string             `yaml:"protocol"`
+	Addresses         []string           `yaml:"addresses"`
+	AutoAssign        *bool              `yaml:"auto-assign,omitempty"`
+	AvoidBuggyIPs     bool               `yaml:"avoid-buggy-ips,omitempty"`
+	BGPAdvertisements []bgpAdvertisement `yaml:"bgp-advertisements,omitempty"`
+}
+
+// bgpAdvertisement is how the addresses of a bgp pool are advertised
+type bgpAdvertisement struct {
+	AggregationLength   *int     `yaml:"aggregation-length,omitempty"`
+	AggregationLengthV6 *int     `yaml:"aggregation-length-v6,omitempty"`
+	LocalPref           *uint32  `yaml:"localpref,omitempty"`
+	Communities         []string `yaml:"communities,omitempty"`
+}
+
+// parseConfig decodes the MetalLB config, rejecting the unknown keys
+// so that typos are reported instead of being silently ignored by MetalLB.
+// It also returns the comment preceding each address pool, which names
+// the AddressPool the pool was generated from.
+func parseConfig(data string) (*configData, []string, error) {
+	config := &configData{}
+	decoder := yaml.NewDecoder(strings.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, nil, errors.Wrapf(err, "invalid MetalLB config")
+	}
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(data), doc); err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid MetalLB config")
+	}
+	sources := make([]string, len(config.AddressPools))
+	if pools := addressPoolsNode(doc); pools != nil {
+		for i, pool := range pools.Content {
+			if i < len(sources) {
+				sources[i] = pool.HeadComment
+			}
+		}
+	}
+	return config, sources, nil
+}
+
+// SetConfigIndent formats the MetalLB config of the ConfigMap with the given
+// indentation width, and records it so that the config merged with the
+// existing ConfigMap is formatted the same way.
+func SetConfigIndent(obj *uns.Unstructured, indent int) error {
+	if indent < 2 {
+		indent = DefaultConfigIndent
+	}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ConfigIndentAnnotation] = strconv.Itoa(indent)
+	obj.SetAnnotations(annotations)
+
+	data, ok, err := uns.NestedString(obj.Object, "data", AddressPoolConfigMap)
+	if !ok || err != nil {
+		return err
+	}
+	config, sources, err := parseConfig(data)
+	if err != nil {
+		return err
+	}
+	formatted, err := marshalConfig(config, sources, indent)
+	if err != nil {
+		return err
+	}
+	return uns.SetNestedField(obj.Object, string(formatted), "data", AddressPoolConfigMap)
+}
+
+// SetSortAddresses sorts the addresses of each pool of the MetalLB config of
+// the ConfigMap when sortAddresses is true, and records it so that the pools
+// of the config merged with the existing ConfigMap are sorted too. The
+// addresses are sorted by IP family and then numerically, so that reordering
+// them in the AddressPool objects doesn't change the config.
+func SetSortAddresses(obj *uns.Unstructured, sortAddresses bool) error {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[SortAddressesAnnotation] = strconv.FormatBool(sortAddresses)
+	obj.SetAnnotations(annotations)
+	if !sortAddresses {
+		return nil
+	}
+
+	data, ok, err := uns.NestedString(obj.Object, "data", AddressPoolConfigMap)
+	if !ok || err != nil {
+		return err
+	}
+	config, sources, err := parseConfig(data)
+	if err != nil {
+		return err
+	}
+	sortPoolAddresses(config.AddressPools)
+	formatted, err := marshalConfig(config, sources, configIndent(obj))
+	if err != nil {
+		return err
+	}
+	return uns.SetNestedField(obj.Object, string(formatted), "data", AddressPoolConfigMap)
+}
+
+// isSortingAddresses returns true if the ConfigMap records that the
+// addresses of its pools are sorted
+func isSortingAddresses(obj *uns.Unstructured) bool {
+	return obj.GetAnnotations()[SortAddressesAnnotation] == "true"
+}
+
+// sortPoolAddresses sorts the addresses of each pool, IPv4 first.
+// The addresses which can't be parsed are kept last, in lexical order.
+func sortPoolAddresses(pools []configPool) {
+	for _, p := range pools {
+		addresses := p.Addresses
+		sort.SliceStable(addresses, func(i, j int) bool {
+			return addressLess(addresses[i], addresses[j])
+		})
+	}
+}
+
+func addressLess(a, b string) bool {
+	ra, errA := pool.ParseRange(a)
+	rb, errB := pool.ParseRange(b)
+	if errA != nil || errB != nil {
+		if errA == nil || errB == nil {
+			return errA == nil
+		}
+		return a < b
+	}
+	if len(ra.First) != len(rb.First) {
+		return len(ra.First) < len(rb.First)
+	}
+	if c := bytes.Compare(ra.First, rb.First); c != 0 {
+		return c < 0
+	}
+	if c := bytes.Compare(ra.Last, rb.Last); c != 0 {
+		return c < 0
+	}
+	return a < b
+}
+
+// ConfigReload returns how MetalLB picks up the changes of the pools of the
+// updated ConfigMap from the current one. The speakers only announce the
+// addresses of a pool with the protocol the pool had when they started, so
+// a change of protocol requires restarting them, while all the other changes
+// are hot reloaded. current is nil when there is no ConfigMap yet.
+func ConfigReload(current, updated *uns.Unstructured) (string, error) {
+	if current == nil {
+		return metallbv1alpha.ConfigReloadHot, nil
+	}
+	currentPools, err := configPools(current)
+	if err != nil {
+		return "", err
+	}
+	updatedPools, err := configPools(updated)
+	if err != nil {
+		return "", err
+	}
+
+	protocols := map[string]string{}
+	for _, p := range currentPools {
+		protocols[p.Name] = p.Protocol
+	}
+	for _, p := range updatedPools {
+		if protocol, ok := protocols[p.Name]; ok && protocol != p.Protocol {
+			return metallbv1alpha.ConfigReloadRestart, nil
+		}
+	}
+	return metallbv1alpha.ConfigReloadHot, nil
+}
+
+// configPools returns the address pools of the MetalLB config of the ConfigMap
+func configPools(obj *uns.Unstructured) ([]configPool, error) {
+	data, ok, err := uns.NestedString(obj.Object, "data", AddressPoolConfigMap)
+	if !ok || err != nil {
+		return nil, err
+	}
+	config, _, err := parseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	return config.AddressPools, nil
+}
+
+// removeConfigPools removes the pools generated from the AddressPool source,
+// named namespace/name, from the MetalLB config of the ConfigMap. The pools
+// without source comment, written before the comments were added, are removed
+// when named poolName, unless it is empty. It returns false, leaving the
+// ConfigMap untouched, when the config has no such pool.
+func removeConfigPools(obj *uns.Unstructured, source, poolName string) (bool, error) {
+	data, ok, err := configTemplate(obj)
+	if !ok || err != nil {
+		return false, err
+	}
+	config, sources, err := parseConfig(data)
+	if err != nil {
+		return false, err
+	}
+
+	pools := make([]configPool, 0, len(config.AddressPools))
+	poolSources := make([]string, 0, len(sources))
+	for i, p := range config.AddressPools {
+		if sources[i] == sourceComment(source) || (sources[i] == "" && poolName != "" && p.Name == poolName) {
+			continue
+		}
+		pools = append(pools, p)
+		poolSources = append(poolSources, sources[i])
+	}
+	if len(pools) == len(config.AddressPools) {
+		return false, nil
+	}
+
+	config.AddressPools = pools
+	formatted, err := marshalConfig(config, poolSources, configIndent(obj))
+	if err != nil {
+		return false, err
+	}
+	return true, uns.SetNestedField(obj.Object, string(formatted), "data", AddressPoolConfigMap)
+}
+
+// sourceComment returns the comment preceding the pools generated from the
+// AddressPool source in the config
+func sourceComment(source string) string {
+	return "# AddressPool " + source
+}
+
+// configIndent returns the indentation width recorded on the ConfigMap
+func configIndent(obj *uns.Unstructured) int {
+	indent, err := strconv.Atoi(obj.GetAnnotations()[ConfigIndentAnnotation])
+	if err != nil || indent < 2 {
+		return DefaultConfigIndent
+	}
+	return indent
+}
+
+// marshalConfig encodes the MetalLB config, each address pool being
+// preceded by its comment in sources.
+// The fields are emitted in declaration order and the keys of maps sorted,
+// so the same pools always produce the same config and the ConfigMap is
+// not updated on every reconcile.
+func marshalConfig(config *configData, sources []string, indent int) ([]byte, error) {
+	doc := &yaml.Node{}
+	if err := doc.Encode(config); err != nil {
+		return nil, err
+	}
+	if pools := addressPoolsNode(doc); pools != nil {
+		for i, pool := range pools.Content {
+			if i < len(sources) {
+				pool.HeadComment = sources[i]
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(indent)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// addressPoolsNode returns the node holding the address pools sequence
+func addressPoolsNode(doc *yaml.Node) *yaml.Node {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	if doc.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		if doc.Content[i].Value == "address-pools" {
+			return doc.Content[i+1]
+		}
+	}
+	return nil
+}
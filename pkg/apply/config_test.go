@@ -0,0 +1,212 @@
+package apply
+
+import (
+	"strings"
+	"testing"
+
+	metallbv1alpha "github.com/metallb/metallb-operator/api/v1alpha1"
+	. "github.com/onsi/gomega"
+	uns "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSetConfigIndent(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: gold
+      protocol: layer2
+      addresses:
+      - 172.20.0.100/24`)
+
+	upd := UnstructuredFromYaml(t, silverConfigMap)
+
+	err := SetConfigIndent(upd, 4)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(upd.GetAnnotations()).To(HaveKeyWithValue(ConfigIndentAnnotation, "4"))
+	config, _, err := uns.NestedString(upd.Object, "data", AddressPoolConfigMap)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config).To(Equal(`address-pools:
+    # AddressPool metallb-system/silver-addresspool
+    - name: silver
+      protocol: layer2
+      addresses:
+        - 172.22.0.100/24
+`))
+
+	err = MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	config, _, err = uns.NestedString(upd.Object, "data", AddressPoolConfigMap)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config).To(Equal(`address-pools:
+    - name: gold
+      protocol: layer2
+      addresses:
+        - 172.20.0.100/24
+    # AddressPool metallb-system/silver-addresspool
+    - name: silver
+      protocol: layer2
+      addresses:
+        - 172.22.0.100/24
+`))
+}
+
+func TestSetSortAddresses(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	shuffled := [][]string{
+		{"fc00:f853:ccd:e799::/124", "172.20.0.100-172.20.0.200", "10.0.0.0/24", "172.3.0.0/24"},
+		{"172.3.0.0/24", "fc00:f853:ccd:e799::/124", "10.0.0.0/24", "172.20.0.100-172.20.0.200"},
+		{"10.0.0.0/24", "172.20.0.100-172.20.0.200", "172.3.0.0/24", "fc00:f853:ccd:e799::/124"},
+	}
+	for _, addresses := range shuffled {
+		upd := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: gold
+      protocol: layer2
+      addresses:
+      - `+strings.Join(addresses, "\n      - "))
+
+		err := SetSortAddresses(upd, true)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(upd.GetAnnotations()).To(HaveKeyWithValue(SortAddressesAnnotation, "true"))
+		config, _, err := uns.NestedString(upd.Object, "data", AddressPoolConfigMap)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(config).To(Equal(`address-pools:
+  - name: gold
+    protocol: layer2
+    addresses:
+      - 10.0.0.0/24
+      - 172.3.0.0/24
+      - 172.20.0.100-172.20.0.200
+      - fc00:f853:ccd:e799::/124
+`))
+	}
+}
+
+func TestMergeConfigMapSortAddresses(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: gold
+      protocol: layer2
+      addresses:
+      - 172.20.0.0/24
+      - 172.10.0.0/24`)
+
+	upd := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: silver
+      protocol: layer2
+      addresses:
+      - 172.22.0.0/24`)
+
+	err := SetSortAddresses(upd, true)
+	g.Expect(err).NotTo(HaveOccurred())
+	err = MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	config, _, err := uns.NestedString(upd.Object, "data", AddressPoolConfigMap)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config).To(ContainSubstring(`      - 172.10.0.0/24
+      - 172.20.0.0/24
+`))
+}
+
+func TestConfigReload(t *testing.T) {
+	configMap := func(protocol string, addresses string) *uns.Unstructured {
+		return UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: gold
+      protocol: `+protocol+`
+      addresses:
+      - `+addresses)
+	}
+
+	tests := []struct {
+		desc     string
+		current  *uns.Unstructured
+		updated  *uns.Unstructured
+		expected string
+	}{
+		{
+			desc:     "new config",
+			updated:  configMap("layer2", "172.20.0.0/24"),
+			expected: metallbv1alpha.ConfigReloadHot,
+		},
+		{
+			desc:     "addresses change",
+			current:  configMap("layer2", "172.20.0.0/24"),
+			updated:  configMap("layer2", "172.30.0.0/24"),
+			expected: metallbv1alpha.ConfigReloadHot,
+		},
+		{
+			desc:     "protocol change",
+			current:  configMap("layer2", "172.20.0.0/24"),
+			updated:  configMap("bgp", "172.20.0.0/24"),
+			expected: metallbv1alpha.ConfigReloadRestart,
+		},
+		{
+			desc:    "new pool",
+			current: configMap("layer2", "172.20.0.0/24"),
+			updated: UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: silver
+      protocol: bgp
+      addresses:
+      - 172.30.0.0/24`),
+			expected: metallbv1alpha.ConfigReloadHot,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			reload, err := ConfigReload(test.current, test.updated)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(reload).To(Equal(test.expected))
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package apply
 
 import (
-	metallbv1alpha "github.com/metallb/metallb-operator/api/v1alpha1"
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/pkg/errors"
-	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	uns "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 // MergeMetadataForUpdate merges the read-only fields of metadata.
@@ -21,6 +25,7 @@ func mergeMetadataForUpdate(current, updated *uns.Unstructured) error {
 
 	mergeAnnotations(current, updated)
 	mergeLabels(current, updated)
+	mergeOwnerReferences(current, updated)
 
 	return nil
 }
@@ -37,6 +42,14 @@ func MergeObjectForUpdate(current, updated *uns.Unstructured) error {
 		return err
 	}
 
+	if err := mergeContainerPortsForUpdate(current, updated); err != nil {
+		return err
+	}
+
+	if err := mergeMinReadySecondsForUpdate(current, updated); err != nil {
+		return err
+	}
+
 	if err := mergeServiceForUpdate(current, updated); err != nil {
 		return err
 	}
@@ -87,61 +100,267 @@ func mergeDeploymentForUpdate(current, updated *uns.Unstructured) error {
 	return nil
 }
 
-// mergeServiceForUpdate ensures the ClusterIP/IPFamily is never modified
-func mergeServiceForUpdate(current, updated *uns.Unstructured) error {
+// mergeContainerPortsForUpdate preserves the named ports added to the containers
+// of Deployments and DaemonSets by someone else, e.g. a policy webhook.
+// Ports present in updated win over the ones in current. For objects whose
+// ports are managed, the ports set by a previous apply and missing in updated
+// are removed.
+func mergeContainerPortsForUpdate(current, updated *uns.Unstructured) error {
 	gvk := updated.GroupVersionKind()
-	if gvk.Group == "" && gvk.Kind == "Service" {
-		clusterIP, found, err := uns.NestedString(current.Object, "spec", "clusterIP")
+	if gvk.Group != "apps" || (gvk.Kind != "Deployment" && gvk.Kind != "DaemonSet") {
+		return nil
+	}
+
+	curContainers, found, err := uns.NestedSlice(current.Object, "spec", "template", "spec", "containers")
+	if err != nil || !found {
+		return err
+	}
+	updContainers, found, err := uns.NestedSlice(updated.Object, "spec", "template", "spec", "containers")
+	if err != nil || !found {
+		return err
+	}
+
+	managed := map[string]bool{}
+	if _, ok := updated.GetAnnotations()[ManagedPortsAnnotation]; ok {
+		for _, p := range managedPorts(current) {
+			managed[p] = true
+		}
+	}
+
+	for i := range updContainers {
+		updContainer, ok := updContainers[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		curContainer := containerByName(curContainers, updContainer["name"])
+		if curContainer == nil {
+			continue
+		}
+		curPorts, _, err := uns.NestedSlice(curContainer, "ports")
 		if err != nil {
 			return err
 		}
-		if found {
-			err = uns.SetNestedField(updated.Object, clusterIP, "spec", "clusterIP")
-			if err != nil {
-				return err
-			}
-		}
-
-		clusterIPs, found, err := uns.NestedStringSlice(current.Object, "spec", "clusterIPs")
+		updPorts, _, err := uns.NestedSlice(updContainer, "ports")
 		if err != nil {
 			return err
 		}
-		if found {
-			err = uns.SetNestedStringSlice(updated.Object, clusterIPs, "spec", "clusterIPs")
-			if err != nil {
+
+		for _, p := range curPorts {
+			curPort, ok := p.(map[string]interface{})
+			if !ok || curPort["name"] == nil || hasPort(updPorts, curPort) {
+				continue
+			}
+			if managed[managedPortKey(updContainer["name"], curPort["name"])] {
+				continue
+			}
+			updPorts = append(updPorts, curPort)
+		}
+		if len(updPorts) > 0 {
+			if err := uns.SetNestedSlice(updContainer, updPorts, "ports"); err != nil {
 				return err
 			}
 		}
+	}
 
-		ipFamilies, found, err := uns.NestedStringSlice(current.Object, "spec", "ipFamilies")
-		if err != nil {
+	return uns.SetNestedSlice(updated.Object, updContainers, "spec", "template", "spec", "containers")
+}
+
+// mergeMinReadySecondsForUpdate preserves the minReadySeconds set by the user on
+// Deployments and DaemonSets, unless updated sets its own value.
+func mergeMinReadySecondsForUpdate(current, updated *uns.Unstructured) error {
+	gvk := updated.GroupVersionKind()
+	if gvk.Group != "apps" || (gvk.Kind != "Deployment" && gvk.Kind != "DaemonSet") {
+		return nil
+	}
+
+	if _, found, err := uns.NestedFieldNoCopy(updated.Object, "spec", "minReadySeconds"); err != nil || found {
+		return err
+	}
+	minReadySeconds, found, err := uns.NestedFieldCopy(current.Object, "spec", "minReadySeconds")
+	if err != nil || !found {
+		return err
+	}
+	return uns.SetNestedField(updated.Object, minReadySeconds, "spec", "minReadySeconds")
+}
+
+func containerByName(containers []interface{}, name interface{}) map[string]interface{} {
+	for _, c := range containers {
+		container, ok := c.(map[string]interface{})
+		if ok && container["name"] == name {
+			return container
+		}
+	}
+	return nil
+}
+
+// portProtocol returns the protocol of the port, TCP if not set
+func portProtocol(p map[string]interface{}) interface{} {
+	if p["protocol"] == nil {
+		return "TCP"
+	}
+	return p["protocol"]
+}
+
+// hasPort returns true if ports contains a port with the same name,
+// or the same container port and protocol as port.
+func hasPort(ports []interface{}, port map[string]interface{}) bool {
+	for _, p := range ports {
+		other, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if other["name"] == port["name"] {
+			return true
+		}
+		if fmt.Sprint(other["containerPort"]) == fmt.Sprint(port["containerPort"]) && portProtocol(other) == portProtocol(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeServiceForUpdate ensures the ClusterIP/IPFamily is never modified, and
+// handles the transitions of the type of the Service, clearing the fields which
+// are not valid anymore for the new type
+func mergeServiceForUpdate(current, updated *uns.Unstructured) error {
+	gvk := updated.GroupVersionKind()
+	if gvk.Group != "" || gvk.Kind != "Service" {
+		return nil
+	}
+
+	curType, updType := serviceType(current), serviceType(updated)
+	if updType == "ExternalName" {
+		// ExternalName services have no cluster IP
+		for _, field := range []string{"clusterIP", "clusterIPs", "ipFamilies", "ipFamilyPolicy"} {
+			uns.RemoveNestedField(updated.Object, "spec", field)
+		}
+		return clearNodePorts(updated)
+	}
+
+	if curType != "ExternalName" {
+		if err := mergeServiceIPsForUpdate(current, updated); err != nil {
 			return err
 		}
-		if found {
-			err = uns.SetNestedStringSlice(updated.Object, ipFamilies, "spec", "ipFamilies")
-			if err != nil {
-				return err
-			}
+	}
+
+	if !hasNodePorts(updType) {
+		return clearNodePorts(updated)
+	}
+	if updType != "LoadBalancer" {
+		uns.RemoveNestedField(updated.Object, "spec", "healthCheckNodePort")
+	}
+	if hasNodePorts(curType) {
+		return mergeNodePortsForUpdate(current, updated)
+	}
+	return nil
+}
+
+func mergeServiceIPsForUpdate(current, updated *uns.Unstructured) error {
+	clusterIP, found, err := uns.NestedString(current.Object, "spec", "clusterIP")
+	if err != nil {
+		return err
+	}
+	if found {
+		err = uns.SetNestedField(updated.Object, clusterIP, "spec", "clusterIP")
+		if err != nil {
+			return err
 		}
+	}
 
-		ipFamilyPolicy, foundOld, err := uns.NestedString(current.Object, "spec", "ipFamilyPolicy")
+	clusterIPs, found, err := uns.NestedStringSlice(current.Object, "spec", "clusterIPs")
+	if err != nil {
+		return err
+	}
+	if found {
+		err = uns.SetNestedStringSlice(updated.Object, clusterIPs, "spec", "clusterIPs")
 		if err != nil {
 			return err
 		}
-		_, foundNew, err := uns.NestedString(updated.Object, "spec", "ipFamilyPolicy")
+	}
+
+	ipFamilies, found, err := uns.NestedStringSlice(current.Object, "spec", "ipFamilies")
+	if err != nil {
+		return err
+	}
+	if found {
+		err = uns.SetNestedStringSlice(updated.Object, ipFamilies, "spec", "ipFamilies")
 		if err != nil {
 			return err
 		}
-		if foundOld && !foundNew {
-			err = uns.SetNestedField(updated.Object, ipFamilyPolicy, "spec", "ipFamilyPolicy")
-			if err != nil {
-				return err
-			}
+	}
+
+	ipFamilyPolicy, foundOld, err := uns.NestedString(current.Object, "spec", "ipFamilyPolicy")
+	if err != nil {
+		return err
+	}
+	_, foundNew, err := uns.NestedString(updated.Object, "spec", "ipFamilyPolicy")
+	if err != nil {
+		return err
+	}
+	if foundOld && !foundNew {
+		err = uns.SetNestedField(updated.Object, ipFamilyPolicy, "spec", "ipFamilyPolicy")
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
+func serviceType(obj *uns.Unstructured) string {
+	t, _, _ := uns.NestedString(obj.Object, "spec", "type")
+	if t == "" {
+		return "ClusterIP"
 	}
+	return t
+}
 
-	return nil
+func hasNodePorts(serviceType string) bool {
+	return serviceType == "NodePort" || serviceType == "LoadBalancer"
+}
+
+// clearNodePorts removes the fields only valid for the Services exposed on the nodes
+func clearNodePorts(updated *uns.Unstructured) error {
+	uns.RemoveNestedField(updated.Object, "spec", "externalTrafficPolicy")
+	uns.RemoveNestedField(updated.Object, "spec", "healthCheckNodePort")
+
+	ports, found, err := uns.NestedSlice(updated.Object, "spec", "ports")
+	if err != nil || !found {
+		return err
+	}
+	for _, p := range ports {
+		if port, ok := p.(map[string]interface{}); ok {
+			delete(port, "nodePort")
+		}
+	}
+	return uns.SetNestedSlice(updated.Object, ports, "spec", "ports")
+}
+
+// mergeNodePortsForUpdate keeps the node ports allocated to the Service,
+// unless updated requests specific ones
+func mergeNodePortsForUpdate(current, updated *uns.Unstructured) error {
+	curPorts, _, err := uns.NestedSlice(current.Object, "spec", "ports")
+	if err != nil {
+		return err
+	}
+	updPorts, found, err := uns.NestedSlice(updated.Object, "spec", "ports")
+	if err != nil || !found {
+		return err
+	}
+	for _, p := range updPorts {
+		updPort, ok := p.(map[string]interface{})
+		if !ok || updPort["nodePort"] != nil {
+			continue
+		}
+		for _, c := range curPorts {
+			curPort, ok := c.(map[string]interface{})
+			if ok && curPort["nodePort"] != nil && fmt.Sprint(curPort["port"]) == fmt.Sprint(updPort["port"]) &&
+				portProtocol(curPort) == portProtocol(updPort) {
+				updPort["nodePort"] = curPort["nodePort"]
+				break
+			}
+		}
+	}
+	return uns.SetNestedSlice(updated.Object, updPorts, "spec", "ports")
 }
 
 // mergeServiceAccountForUpdate copies secrets from current to updated.
@@ -190,8 +409,60 @@ func mergeAnnotations(current, updated *uns.Unstructured) {
 	}
 }
 
+// mergeOwnerReferences copies over the owner references of current missing
+// in updated, so that the owners set by others are kept. When updated has a
+// controller reference, it replaces the one of current.
+func mergeOwnerReferences(current, updated *uns.Unstructured) {
+	updatedRefs := updated.GetOwnerReferences()
+	hasController := false
+	for _, ref := range updatedRefs {
+		if ref.Controller != nil && *ref.Controller {
+			hasController = true
+		}
+	}
+
+	refs := updatedRefs
+	for _, ref := range current.GetOwnerReferences() {
+		if hasController && ref.Controller != nil && *ref.Controller {
+			continue
+		}
+		if !hasOwnerReference(updatedRefs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+
+	if len(refs) != 0 {
+		updated.SetOwnerReferences(refs)
+	}
+}
+
+// hasOwnerReference returns true if refs reference the same owner as ref
+func hasOwnerReference(refs []metav1.OwnerReference, ref metav1.OwnerReference) bool {
+	for _, r := range refs {
+		if r.UID == ref.UID || (r.Kind == ref.Kind && r.Name == ref.Name && sameGroup(r.APIVersion, ref.APIVersion)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameGroup returns true if the API versions belong to the same group
+func sameGroup(apiVersion, other string) bool {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return false
+	}
+	otherGV, err := schema.ParseGroupVersion(other)
+	if err != nil {
+		return false
+	}
+	return gv.Group == otherGV.Group
+}
+
 // mergeLabels copies over any labels from current to updated,
-// with updated winning if there's a conflict
+// with updated winning if there's a conflict.
+// For objects whose labels are managed, the labels set by a previous
+// apply and missing in updated are removed.
 func mergeLabels(current, updated *uns.Unstructured) {
 	updatedLabels := updated.GetLabels()
 	curLabels := current.GetLabels()
@@ -200,6 +471,14 @@ func mergeLabels(current, updated *uns.Unstructured) {
 		curLabels = map[string]string{}
 	}
 
+	if _, ok := updated.GetAnnotations()[ManagedLabelsAnnotation]; ok {
+		for _, k := range managedLabels(current) {
+			if _, ok := updatedLabels[k]; !ok {
+				delete(curLabels, k)
+			}
+		}
+	}
+
 	for k, v := range updatedLabels {
 		curLabels[k] = v
 	}
@@ -209,16 +488,111 @@ func mergeLabels(current, updated *uns.Unstructured) {
 	}
 }
 
-func mergeConfigMapForUpdate(current, updated *uns.Unstructured) error {
-	type configMapData struct {
-		AddressPools []metallbv1alpha.AddressPoolSpec `yaml:"address-pools"`
+// ManagedLabelsAnnotation lists the labels of an object set by the operator,
+// so that they can be removed once they are not desired anymore.
+const ManagedLabelsAnnotation = "metallb.io/managed-labels"
+
+// SetManagedLabels adds the labels to the object, recording them as managed
+// so that the ones dropped on a later apply are removed from the object.
+func SetManagedLabels(obj *uns.Unstructured, labels map[string]string) {
+	objLabels := obj.GetLabels()
+	if objLabels == nil {
+		objLabels = map[string]string{}
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k, v := range labels {
+		objLabels[k] = v
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ManagedLabelsAnnotation] = strings.Join(keys, ",")
+
+	if len(objLabels) != 0 {
+		obj.SetLabels(objLabels)
+	}
+	obj.SetAnnotations(annotations)
+}
+
+func managedLabels(obj *uns.Unstructured) []string {
+	managed := obj.GetAnnotations()[ManagedLabelsAnnotation]
+	if managed == "" {
+		return nil
+	}
+	return strings.Split(managed, ",")
+}
+
+// ManagedPortsAnnotation lists the named container ports of a workload set by
+// the operator, so that they are removed once they are not desired anymore
+// rather than kept as the ports added by others.
+const ManagedPortsAnnotation = "metallb.io/managed-ports"
+
+// SetManagedPorts records the named ports of the containers of the Deployment
+// or DaemonSet as managed, so that the ones dropped on a later apply are
+// removed from the object.
+func SetManagedPorts(obj *uns.Unstructured) error {
+	gvk := obj.GroupVersionKind()
+	if gvk.Group != "apps" || (gvk.Kind != "Deployment" && gvk.Kind != "DaemonSet") {
+		return nil
+	}
+	containers, _, err := uns.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	if err != nil {
+		return err
 	}
 
+	keys := []string{}
+	for _, c := range containers {
+		container, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ports, _, err := uns.NestedSlice(container, "ports")
+		if err != nil {
+			return err
+		}
+		for _, p := range ports {
+			port, ok := p.(map[string]interface{})
+			if ok && port["name"] != nil {
+				keys = append(keys, managedPortKey(container["name"], port["name"]))
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ManagedPortsAnnotation] = strings.Join(keys, ",")
+	obj.SetAnnotations(annotations)
+	return nil
+}
+
+func managedPorts(obj *uns.Unstructured) []string {
+	managed := obj.GetAnnotations()[ManagedPortsAnnotation]
+	if managed == "" {
+		return nil
+	}
+	return strings.Split(managed, ",")
+}
+
+// managedPortKey identifies a named port of a container in the ManagedPortsAnnotation
+func managedPortKey(container, port interface{}) string {
+	return fmt.Sprintf("%v/%v", container, port)
+}
+
+func mergeConfigMapForUpdate(current, updated *uns.Unstructured) error {
 	if gvk := updated.GroupVersionKind(); gvk.Kind != "ConfigMap" || gvk.Group != "" {
 		return nil
 	}
 
-	s1, ok, err := uns.NestedString(current.Object, "data", AddressPoolConfigMap)
+	// The placeholders of the existing config are kept, to be resolved again
+	s1, ok, err := configTemplate(current)
 	if ok == false || err != nil {
 		return err
 	}
@@ -228,20 +602,27 @@ func mergeConfigMapForUpdate(current, updated *uns.Unstructured) error {
 		return err
 	}
 
-	st1, st2 := configMapData{}, configMapData{}
-
-	if err := yaml.Unmarshal([]byte(s1), &st1); err != nil {
+	st1, sources1, err := parseConfig(s1)
+	if err != nil {
 		return err
 	}
 
-	if err := yaml.Unmarshal([]byte(s2), &st2); err != nil {
+	st2, sources2, err := parseConfig(s2)
+	if err != nil {
 		return err
 	}
 
-	var mergedConfigMap configMapData
-	mergedConfigMap.AddressPools = append(st1.AddressPools, st2.AddressPools...)
+	pools, sources := mergeConfigPools(st1.AddressPools, sources1, st2.AddressPools, sources2)
+	mergedConfigMap := configData{
+		Peers:          st1.Peers,
+		BGPCommunities: st1.BGPCommunities,
+		AddressPools:   pools,
+	}
+	if isSortingAddresses(updated) {
+		sortPoolAddresses(mergedConfigMap.AddressPools)
+	}
 
-	resData, err := yaml.Marshal(mergedConfigMap)
+	resData, err := marshalConfig(&mergedConfigMap, sources, configIndent(updated))
 	if err != nil {
 		return err
 	}
@@ -252,6 +633,51 @@ func mergeConfigMapForUpdate(current, updated *uns.Unstructured) error {
 	return err
 }
 
+// mergeConfigPools merges the updated pools with the current ones, returning
+// the pools along with their source comments. A current pool generated from
+// the same AddressPool as an updated pool, or named the same, is replaced in
+// place by it, so that reconciling an AddressPool again neither duplicates
+// its pool nor moves it in the config. The other updated pools are appended.
+func mergeConfigPools(current []configPool, currentSources []string, updated []configPool, updatedSources []string) ([]configPool, []string) {
+	pools := make([]configPool, 0, len(current)+len(updated))
+	sources := make([]string, 0, len(current)+len(updated))
+	merged := make([]bool, len(updated))
+	for i, p := range current {
+		j := matchingPool(p, currentSources[i], updated, updatedSources)
+		if j < 0 {
+			pools = append(pools, p)
+			sources = append(sources, currentSources[i])
+			continue
+		}
+		// The duplicates left by the previous versions of the merge are dropped
+		if merged[j] {
+			continue
+		}
+		merged[j] = true
+		pools = append(pools, updated[j])
+		sources = append(sources, updatedSources[j])
+	}
+	for j, p := range updated {
+		if !merged[j] {
+			pools = append(pools, p)
+			sources = append(sources, updatedSources[j])
+		}
+	}
+	return pools, sources
+}
+
+// matchingPool returns the index of the pool generated from the same
+// AddressPool as p, as told by their source comments, or named the same.
+// It returns -1 if there is none.
+func matchingPool(p configPool, source string, pools []configPool, sources []string) int {
+	for i := range pools {
+		if (source != "" && source == sources[i]) || p.Name == pools[i].Name {
+			return i
+		}
+	}
+	return -1
+}
+
 // IsObjectSupported rejects objects with configurations we don't support.
 // This catches ServiceAccounts with secrets, which is valid but we don't
 // support reconciling them.
@@ -287,6 +287,26 @@ metadata:
 	g.Expect(s).To(ConsistOf("foo"))
 }
 
+// silverConfigMap is the config ConfigMap holding the silver pool, rendered
+// from the address pool template: the template leaves a blank line after the
+// addresses key
+const silverConfigMap = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    # AddressPool metallb-system/silver-addresspool
+    - name: silver
+      protocol: layer2
+      addresses:
+
+      - 172.22.0.100/24
+`
+
 // UnstructuredFromYaml creates an unstructured object from a raw yaml string
 func UnstructuredFromYaml(t *testing.T, obj string) *uns.Unstructured {
 	t.Helper()
@@ -412,10 +432,747 @@ data:
   protocol: layer2
   addresses:
   - 172.30.0.100/24
-- name: blue
+`))
+}
+
+func TestMergeConfigMapReplacesPools(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    # AddressPool metallb-system/gold-addresspool
+    - name: gold
+      protocol: layer2
+      addresses:
+      - 172.20.0.100/24
+    - name: manual
+      protocol: layer2
+      addresses:
+      - 172.21.0.100/24
+    # AddressPool metallb-system/gold-addresspool
+    - name: gold
+      protocol: layer2
+      addresses:
+      - 172.20.0.100/24`)
+
+	// The pool generated from the same AddressPool is replaced, even renamed,
+	// and the duplicates are dropped
+	upd := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    # AddressPool metallb-system/gold-addresspool
+    - name: platinum
+      protocol: bgp
+      addresses:
+      - 172.20.0.100/24`)
+
+	err := MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	config, _, err := uns.NestedString(upd.Object, "data", AddressPoolConfigMap)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config).To(Equal(`address-pools:
+  # AddressPool metallb-system/gold-addresspool
+  - name: platinum
+    protocol: bgp
+    addresses:
+      - 172.20.0.100/24
+  - name: manual
+    protocol: layer2
+    addresses:
+      - 172.21.0.100/24
+`))
+
+	// The pool without source comment is replaced by the pool of the same name
+	cur = UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    # AddressPool metallb-system/gold-addresspool
+    - name: gold
+      protocol: layer2
+      addresses:
+      - 172.20.0.100/24
+    - name: manual
+      protocol: layer2
+      addresses:
+      - 172.21.0.100/24`)
+	upd = UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    # AddressPool metallb-system/manual-addresspool
+    - name: manual
+      protocol: layer2
+      addresses:
+      - 172.23.0.100/24`)
+
+	err = MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	config, _, err = uns.NestedString(upd.Object, "data", AddressPoolConfigMap)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config).To(Equal(`address-pools:
+  # AddressPool metallb-system/gold-addresspool
+  - name: gold
+    protocol: layer2
+    addresses:
+      - 172.20.0.100/24
+  # AddressPool metallb-system/manual-addresspool
+  - name: manual
+    protocol: layer2
+    addresses:
+      - 172.23.0.100/24
+`))
+}
+
+func TestMergeConfigMapManagedLabels(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+  labels:
+    external: cur`)
+
+	upd := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system`)
+
+	SetManagedLabels(upd, map[string]string{"backup": "true", "team": "net"})
+	err := MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(upd.GetLabels()).To(Equal(map[string]string{
+		"external": "cur",
+		"backup":   "true",
+		"team":     "net",
+	}))
+	g.Expect(upd.GetAnnotations()).To(HaveKeyWithValue(ManagedLabelsAnnotation, "backup,team"))
+
+	// "team" is not desired anymore, and must be removed while the
+	// labels not set by the operator are preserved
+	cur = upd
+	upd = UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system`)
+
+	SetManagedLabels(upd, map[string]string{"backup": "true"})
+	err = MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(upd.GetLabels()).To(Equal(map[string]string{
+		"external": "cur",
+		"backup":   "true",
+	}))
+	g.Expect(upd.GetAnnotations()).To(HaveKeyWithValue(ManagedLabelsAnnotation, "backup"))
+
+	cur = upd
+	upd = UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system`)
+
+	SetManagedLabels(upd, nil)
+	err = MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(upd.GetLabels()).To(Equal(map[string]string{
+		"external": "cur",
+	}))
+}
+
+func TestMergeDeploymentContainerPorts(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: controller
+spec:
+  template:
+    spec:
+      containers:
+      - name: controller
+        ports:
+        - containerPort: 7472
+          name: monitoring
+        - containerPort: 15090
+          name: sidecar-metrics
+        - containerPort: 7473
+          name: removed`)
+
+	upd := UnstructuredFromYaml(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: controller
+spec:
+  template:
+    spec:
+      containers:
+      - name: controller
+        ports:
+        - containerPort: 7472
+          name: monitoring
+        - containerPort: 7473
+          name: metrics`)
+
+	err := MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	containers, _, err := uns.NestedSlice(upd.Object, "spec", "template", "spec", "containers")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(containers).To(HaveLen(1))
+	ports, _, err := uns.NestedSlice(containers[0].(map[string]interface{}), "ports")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// the externally added port survives, while the one conflicting with
+	// an updated port is dropped
+	g.Expect(ports).To(Equal([]interface{}{
+		map[string]interface{}{"containerPort": int64(7472), "name": "monitoring"},
+		map[string]interface{}{"containerPort": int64(7473), "name": "metrics"},
+		map[string]interface{}{"containerPort": int64(15090), "name": "sidecar-metrics"},
+	}))
+}
+
+func TestMergeDeploymentManagedPorts(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: controller
+  annotations:
+    metallb.io/managed-ports: controller/monitoring
+spec:
+  template:
+    spec:
+      containers:
+      - name: controller
+        ports:
+        - containerPort: 7472
+          name: monitoring
+        - containerPort: 15090
+          name: sidecar-metrics`)
+
+	upd := UnstructuredFromYaml(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: controller
+spec:
+  template:
+    spec:
+      containers:
+      - name: controller
+      - name: kube-rbac-proxy
+        ports:
+        - containerPort: 9120
+          name: monitoring`)
+	err := SetManagedPorts(upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(upd.GetAnnotations()).To(HaveKeyWithValue(ManagedPortsAnnotation, "kube-rbac-proxy/monitoring"))
+
+	err = MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	containers, _, err := uns.NestedSlice(upd.Object, "spec", "template", "spec", "containers")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(containers).To(HaveLen(2))
+	ports, _, err := uns.NestedSlice(containers[0].(map[string]interface{}), "ports")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// the port dropped from the managed ones is removed, while the
+	// externally added port survives
+	g.Expect(ports).To(Equal([]interface{}{
+		map[string]interface{}{"containerPort": int64(15090), "name": "sidecar-metrics"},
+	}))
+	g.Expect(upd.GetAnnotations()).To(HaveKeyWithValue(ManagedPortsAnnotation, "kube-rbac-proxy/monitoring"))
+}
+
+func TestMergeConfigMapDeterministic(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	merge := func() string {
+		cur := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: green
+      protocol: layer2
+      addresses:
+      - 172.10.0.100/24
+      - 172.11.0.100-172.11.0.200`)
+
+		upd := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: blue
+      protocol: bgp
+      addresses:
+      - 172.20.0.100/24
+      auto-assign: false`)
+		SetManagedLabels(upd, map[string]string{"team": "net", "backup": "true", "env": "prod"})
+
+		err := MergeObjectForUpdate(cur, upd)
+		g.Expect(err).NotTo(HaveOccurred())
+		config, _, err := uns.NestedString(upd.Object, "data", AddressPoolConfigMap)
+		g.Expect(err).NotTo(HaveOccurred())
+		return config + upd.GetAnnotations()[ManagedLabelsAnnotation]
+	}
+
+	expected := merge()
+	for i := 0; i < 50; i++ {
+		g.Expect(merge()).To(Equal(expected))
+	}
+}
+
+func TestMergeConfigMapUnknownKey(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    adress-pools:
+    - name: gold
+      protocol: layer2
+      addresses:
+      - 172.20.0.100/24`)
+
+	upd := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: silver
+      protocol: layer2
+      addresses:
+      - 172.22.0.100/24`)
+
+	err := MergeObjectForUpdate(cur, upd)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("invalid MetalLB config"))
+	g.Expect(err.Error()).To(ContainSubstring("adress-pools"))
+}
+
+func TestMergeConfigMapKeepsPeers(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    peers:
+    - peer-address: 10.0.0.1
+      peer-asn: 64501
+      my-asn: 64500
+    bgp-communities:
+      no-advertise: 65535:65282
+    address-pools:
+    - name: gold
+      protocol: bgp
+      addresses:
+      - 172.20.0.100/24`)
+
+	upd := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: silver
+      protocol: layer2
+      addresses:
+      - 172.22.0.100/24`)
+
+	err := MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	configmap, _, err := uns.NestedStringMap(upd.Object, "data")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configmap[AddressPoolConfigMap]).Should(MatchYAML(`peers:
+- peer-address: 10.0.0.1
+  peer-asn: 64501
+  my-asn: 64500
+bgp-communities:
+  no-advertise: 65535:65282
+address-pools:
+- name: gold
+  protocol: bgp
+  addresses:
+  - 172.20.0.100/24
+- name: silver
   protocol: layer2
   addresses:
+  - 172.22.0.100/24
+`))
+}
+
+func TestMergeConfigMapKeepsPoolSettings(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: gold
+      protocol: bgp
+      avoid-buggy-ips: true
+      addresses:
+      - 172.20.0.100/24
+      bgp-advertisements:
+      - aggregation-length: 32
+        localpref: 100
+        communities:
+        - no-advertise
+      - aggregation-length: 24`)
+
+	upd := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: silver
+      protocol: layer2
+      addresses:
+      - 172.22.0.100/24`)
+
+	err := MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	configmap, _, err := uns.NestedStringMap(upd.Object, "data")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(configmap[AddressPoolConfigMap]).Should(MatchYAML(`address-pools:
+- name: gold
+  protocol: bgp
+  avoid-buggy-ips: true
+  addresses:
   - 172.20.0.100/24
-  auto-assign: false
+  bgp-advertisements:
+  - aggregation-length: 32
+    localpref: 100
+    communities:
+    - no-advertise
+  - aggregation-length: 24
+- name: silver
+  protocol: layer2
+  addresses:
+  - 172.22.0.100/24
+`))
+}
+
+func TestMergeMinReadySeconds(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, kind := range []string{"Deployment", "DaemonSet"} {
+		cur := UnstructuredFromYaml(t, `
+apiVersion: apps/v1
+kind: `+kind+`
+metadata:
+  name: speaker
+spec:
+  minReadySeconds: 10`)
+
+		upd := UnstructuredFromYaml(t, `
+apiVersion: apps/v1
+kind: `+kind+`
+metadata:
+  name: speaker
+spec: {}`)
+
+		err := MergeObjectForUpdate(cur, upd)
+		g.Expect(err).NotTo(HaveOccurred())
+		minReadySeconds, found, err := uns.NestedInt64(upd.Object, "spec", "minReadySeconds")
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(found).To(BeTrue())
+		g.Expect(minReadySeconds).To(Equal(int64(10)))
+
+		upd = UnstructuredFromYaml(t, `
+apiVersion: apps/v1
+kind: `+kind+`
+metadata:
+  name: speaker
+spec:
+  minReadySeconds: 5`)
+
+		err = MergeObjectForUpdate(cur, upd)
+		g.Expect(err).NotTo(HaveOccurred())
+		minReadySeconds, _, err = uns.NestedInt64(upd.Object, "spec", "minReadySeconds")
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(minReadySeconds).To(Equal(int64(5)))
+	}
+}
+
+func TestMergeConfigMapSourceComments(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    # AddressPool metallb-system/gold-addresspool
+    - name: gold
+      protocol: layer2
+      addresses:
+      - 172.20.0.100/24
+    - name: manual
+      protocol: layer2
+      addresses:
+      - 172.21.0.100/24`)
+
+	upd := UnstructuredFromYaml(t, silverConfigMap)
+
+	err := MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	config, _, err := uns.NestedString(upd.Object, "data", AddressPoolConfigMap)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config).To(Equal(`address-pools:
+  # AddressPool metallb-system/gold-addresspool
+  - name: gold
+    protocol: layer2
+    addresses:
+      - 172.20.0.100/24
+  - name: manual
+    protocol: layer2
+    addresses:
+      - 172.21.0.100/24
+  # AddressPool metallb-system/silver-addresspool
+  - name: silver
+    protocol: layer2
+    addresses:
+      - 172.22.0.100/24
 `))
 }
+
+func TestMergeServiceTypeTransition(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: d1
+spec:
+  type: ClusterIP
+  clusterIP: 10.96.0.10
+  clusterIPs: ["10.96.0.10"]
+  ports:
+  - port: 7472
+    protocol: TCP`)
+
+	upd := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: d1
+spec:
+  type: NodePort
+  externalTrafficPolicy: Local
+  ports:
+  - port: 7472`)
+
+	// ClusterIP to NodePort: the cluster IP is immutable and kept
+	err := MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	ip, _, err := uns.NestedString(upd.Object, "spec", "clusterIP")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ip).To(Equal("10.96.0.10"))
+	policy, _, err := uns.NestedString(upd.Object, "spec", "externalTrafficPolicy")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(policy).To(Equal("Local"))
+
+	// The node ports allocated to the NodePort service are kept
+	cur = UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: d1
+spec:
+  type: NodePort
+  clusterIP: 10.96.0.10
+  externalTrafficPolicy: Local
+  ports:
+  - port: 7472
+    protocol: TCP
+    nodePort: 30472`)
+
+	upd = UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: d1
+spec:
+  type: NodePort
+  ports:
+  - port: 7472`)
+
+	err = MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	ports, _, err := uns.NestedSlice(upd.Object, "spec", "ports")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ports[0]).To(HaveKeyWithValue("nodePort", int64(30472)))
+
+	// NodePort to ClusterIP: the fields of the node ports are cleared
+	upd = UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: d1
+spec:
+  type: ClusterIP
+  externalTrafficPolicy: Local
+  ports:
+  - port: 7472
+    nodePort: 30472`)
+
+	err = MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	ports, _, err = uns.NestedSlice(upd.Object, "spec", "ports")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ports[0]).NotTo(HaveKey("nodePort"))
+	_, found, err := uns.NestedString(upd.Object, "spec", "externalTrafficPolicy")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+	ip, _, err = uns.NestedString(upd.Object, "spec", "clusterIP")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ip).To(Equal("10.96.0.10"))
+
+	// ExternalName services have no cluster IP
+	upd = UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: d1
+spec:
+  type: ExternalName
+  externalName: metallb.example.com`)
+
+	err = MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, found, err = uns.NestedString(upd.Object, "spec", "clusterIP")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+}
+
+func TestMergeOwnerReferences(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cur := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  ownerReferences:
+  - apiVersion: argoproj.io/v1alpha1
+    kind: Application
+    name: metallb
+    uid: c0ffee
+  - apiVersion: metallb.io/v1alpha1
+    kind: Metallb
+    name: metallb
+    uid: old
+    controller: true`)
+
+	upd := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  ownerReferences:
+  - apiVersion: metallb.io/v1alpha1
+    kind: Metallb
+    name: metallb
+    uid: new
+    controller: true`)
+
+	err := MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	refs := upd.GetOwnerReferences()
+	g.Expect(refs).To(HaveLen(2))
+	g.Expect(string(refs[0].UID)).To(Equal("new"))
+	g.Expect(string(refs[1].UID)).To(Equal("c0ffee"))
+
+	upd = UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config`)
+
+	err = MergeObjectForUpdate(cur, upd)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(upd.GetOwnerReferences()).To(Equal(cur.GetOwnerReferences()))
+}
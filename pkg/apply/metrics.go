@@ -0,0 +1,40 @@
+package apply
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	uns "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	configWrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "metallb_operator_config_writes_total",
+		Help: "Number of creations and updates of the MetalLB config ConfigMap.",
+	})
+	configWritesSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "metallb_operator_config_write_skipped_total",
+		Help: "Number of updates of the MetalLB config ConfigMap skipped as the merged config was unchanged.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(configWrites, configWritesSkipped)
+}
+
+// isConfigMap returns true if the object is the MetalLB config ConfigMap
+func isConfigMap(obj *uns.Unstructured) bool {
+	return obj.GetKind() == "ConfigMap" && obj.GetName() == AddressPoolConfigMap
+}
+
+// countConfigWrite records a write of the object if it is the config ConfigMap,
+// or a skipped write if skipped is true
+func countConfigWrite(obj *uns.Unstructured, skipped bool) {
+	if !isConfigMap(obj) {
+		return
+	}
+	if skipped {
+		configWritesSkipped.Inc()
+		return
+	}
+	configWrites.Inc()
+}
@@ -0,0 +1,186 @@
+package apply
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	uns "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ConfigTemplateAnnotation records the MetalLB config of the ConfigMap with
+	// its placeholders, so that they are resolved again on every apply rather
+	// than lost once replaced by their values
+	ConfigTemplateAnnotation = "metallb.io/config-template"
+	// ConfigChecksumAnnotation records the checksum of the resolved config, to
+	// tell whether the config was edited since the template was recorded
+	ConfigChecksumAnnotation = "metallb.io/config-checksum"
+)
+
+// redacted replaces the values resolved from Secrets in the error messages
+const redacted = "<redacted>"
+
+// secretPlaceholder matches the ${secret:name/key} placeholders
+var secretPlaceholder = regexp.MustCompile(`\$\{secret:([^/}]+)/([^}]+)\}`)
+
+// SecretResolver resolves the ${secret:name/key} placeholders of the MetalLB
+// config from the Secrets of the namespace of the config, so that sensitive
+// values don't have to be stored in the AddressPool objects. It remembers the
+// values it resolved in order to redact them from the error messages.
+type SecretResolver struct {
+	Client    k8sclient.Reader
+	Namespace string
+
+	values []string
+}
+
+// Resolve replaces the placeholders of the MetalLB config of the ConfigMap by
+// the values of the referenced Secret keys, recording the config with its
+// placeholders in the ConfigTemplateAnnotation. It is called on the config
+// merged with the existing ConfigMap, as the peers kept from the existing
+// config are where the placeholders usually are. It does nothing on a nil
+// SecretResolver.
+func (r *SecretResolver) Resolve(ctx context.Context, obj *uns.Unstructured) error {
+	if r == nil {
+		return nil
+	}
+	data, ok, err := uns.NestedString(obj.Object, "data", AddressPoolConfigMap)
+	if !ok || err != nil {
+		return err
+	}
+	annotations := obj.GetAnnotations()
+	if !secretPlaceholder.MatchString(data) {
+		if annotations != nil {
+			delete(annotations, ConfigTemplateAnnotation)
+			delete(annotations, ConfigChecksumAnnotation)
+			obj.SetAnnotations(annotations)
+		}
+		return nil
+	}
+
+	// The values are replaced in the scalars of the config rather than in its
+	// text, so that they are quoted as needed when the config is written
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(data), doc); err != nil {
+		return errors.Wrapf(err, "invalid MetalLB config")
+	}
+	if err := r.resolveNode(ctx, doc); err != nil {
+		return err
+	}
+	_, sources, err := parseConfig(data)
+	if err != nil {
+		return err
+	}
+	config := &configData{}
+	if err := doc.Decode(config); err != nil {
+		return r.RedactError(err)
+	}
+	formatted, err := marshalConfig(config, sources, configIndent(obj))
+	if err != nil {
+		return r.RedactError(err)
+	}
+
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ConfigTemplateAnnotation] = data
+	annotations[ConfigChecksumAnnotation] = configChecksum(string(formatted))
+	obj.SetAnnotations(annotations)
+	return uns.SetNestedField(obj.Object, string(formatted), "data", AddressPoolConfigMap)
+}
+
+// configTemplate returns the MetalLB config of the ConfigMap with its
+// placeholders. The recorded template is ignored when the config was edited
+// since it was resolved, the edited config winning.
+func configTemplate(obj *uns.Unstructured) (string, bool, error) {
+	data, ok, err := uns.NestedString(obj.Object, "data", AddressPoolConfigMap)
+	if !ok || err != nil {
+		return "", ok, err
+	}
+	annotations := obj.GetAnnotations()
+	template, ok := annotations[ConfigTemplateAnnotation]
+	if !ok || annotations[ConfigChecksumAnnotation] != configChecksum(data) {
+		return data, true, nil
+	}
+	return template, true, nil
+}
+
+func configChecksum(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r *SecretResolver) resolveNode(ctx context.Context, node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		value, err := r.resolveString(ctx, node.Value)
+		if err != nil {
+			return err
+		}
+		node.Value = value
+		return nil
+	}
+	for _, child := range node.Content {
+		if err := r.resolveNode(ctx, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveString replaces the placeholders of s by the values of the Secret keys
+func (r *SecretResolver) resolveString(ctx context.Context, s string) (string, error) {
+	var resolveErr error
+	res := secretPlaceholder.ReplaceAllStringFunc(s, func(placeholder string) string {
+		if resolveErr != nil {
+			return placeholder
+		}
+		match := secretPlaceholder.FindStringSubmatch(placeholder)
+		value, err := r.secretValue(ctx, match[1], match[2])
+		if err != nil {
+			resolveErr = errors.Wrapf(err, "failed to resolve %s", placeholder)
+			return placeholder
+		}
+		return value
+	})
+	return res, resolveErr
+}
+
+func (r *SecretResolver) secretValue(ctx context.Context, name, key string) (string, error) {
+	secret := &corev1.Secret{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: r.Namespace}, secret); err != nil {
+		return "", err
+	}
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", errors.Errorf("secret %s/%s has no key %s", r.Namespace, name, key)
+	}
+	if len(value) > 0 {
+		r.values = append(r.values, string(value))
+	}
+	return string(value), nil
+}
+
+// Redact replaces the values resolved so far in s
+func (r *SecretResolver) Redact(s string) string {
+	for _, value := range r.values {
+		s = strings.ReplaceAll(s, value, redacted)
+	}
+	return s
+}
+
+// RedactError returns err with the values resolved so far redacted from its
+// message, or nil if err is nil
+func (r *SecretResolver) RedactError(err error) error {
+	if err == nil || len(r.values) == 0 {
+		return err
+	}
+	return errors.New(r.Redact(err.Error()))
+}
@@ -0,0 +1,164 @@
+package apply
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	uns "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestApplyConfigMapResolvesSecrets(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "bgp-auth", Namespace: "metallb-system"},
+		Data:       map[string][]byte{"password": []byte("s3cr3t: #1")},
+	}
+	existing := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    peers:
+    - peer-address: 10.0.0.1
+      peer-asn: 64501
+      my-asn: 64500
+      password: ${secret:bgp-auth/password}
+    address-pools: []`)
+	client := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(secret, existing).Build()
+
+	config := func() (string, map[string]string) {
+		obj := UnstructuredFromYaml(t, testConfigMap)
+		err := client.Get(context.Background(), k8sclient.ObjectKeyFromObject(obj), obj)
+		g.Expect(err).ToNot(HaveOccurred())
+		data, _, err := uns.NestedString(obj.Object, "data", AddressPoolConfigMap)
+		g.Expect(err).ToNot(HaveOccurred())
+		return data, obj.GetAnnotations()
+	}
+
+	// The password of the peer kept from the existing config is resolved
+	resolver := &SecretResolver{Client: client, Namespace: "metallb-system"}
+	changed, err := ApplyConfigMap(context.Background(), client, UnstructuredFromYaml(t, testConfigMap), resolver)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(changed).To(BeTrue())
+	data, annotations := config()
+	g.Expect(data).NotTo(ContainSubstring("${secret:"))
+	g.Expect(data).To(ContainSubstring("# AddressPool metallb-system/gold"))
+	g.Expect(data).Should(MatchYAML(`peers:
+- peer-address: 10.0.0.1
+  peer-asn: 64501
+  my-asn: 64500
+  password: "s3cr3t: #1"
+address-pools:
+- name: gold
+  protocol: layer2
+  addresses:
+  - 172.20.0.100/24
+`))
+	g.Expect(annotations[ConfigTemplateAnnotation]).To(ContainSubstring("password: ${secret:bgp-auth/password}"))
+	g.Expect(annotations[ConfigTemplateAnnotation]).NotTo(ContainSubstring("s3cr3t"))
+
+	err = resolver.RedactError(errors.New(`invalid config: password "s3cr3t: #1" is too short`))
+	g.Expect(err).To(MatchError(`invalid config: password "<redacted>" is too short`))
+	g.Expect(resolver.RedactError(nil)).To(BeNil())
+
+	// The placeholder is kept, so that the new value of the Secret is
+	// resolved on the next apply
+	secret.Data["password"] = []byte("rotated")
+	err = client.Update(context.Background(), secret)
+	g.Expect(err).ToNot(HaveOccurred())
+	resolver = &SecretResolver{Client: client, Namespace: "metallb-system"}
+	changed, err = ApplyConfigMap(context.Background(), client, UnstructuredFromYaml(t, noPoolsConfigMap), resolver)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(changed).To(BeTrue())
+	data, _ = config()
+	g.Expect(data).To(ContainSubstring("password: rotated"))
+	g.Expect(data).To(ContainSubstring("172.20.0.100/24"))
+
+	// The ConfigMap is left untouched when the resolved config is unchanged
+	changed, err = ApplyConfigMap(context.Background(), client, UnstructuredFromYaml(t, testConfigMap), resolver)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(changed).To(BeFalse())
+}
+
+func TestApplyConfigMapKeepsEditedConfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "bgp-auth", Namespace: "metallb-system"},
+		Data:       map[string][]byte{"password": []byte("s3cr3t")},
+	}
+	existing := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+  annotations:
+    metallb.io/config-checksum: outdated
+    metallb.io/config-template: |
+      peers:
+      - peer-address: 10.0.0.1
+        password: ${secret:bgp-auth/password}
+      address-pools: []
+data:
+  config: |
+    peers:
+    - peer-address: 10.0.0.2
+      password: edited
+    address-pools: []`)
+	client := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(secret, existing).Build()
+
+	// The template doesn't match the config edited since, which wins
+	resolver := &SecretResolver{Client: client, Namespace: "metallb-system"}
+	_, err := ApplyConfigMap(context.Background(), client, UnstructuredFromYaml(t, testConfigMap), resolver)
+	g.Expect(err).ToNot(HaveOccurred())
+	obj := UnstructuredFromYaml(t, testConfigMap)
+	err = client.Get(context.Background(), k8sclient.ObjectKeyFromObject(obj), obj)
+	g.Expect(err).ToNot(HaveOccurred())
+	data, _, err := uns.NestedString(obj.Object, "data", AddressPoolConfigMap)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(data).To(ContainSubstring("peer-address: 10.0.0.2"))
+	g.Expect(data).NotTo(ContainSubstring("10.0.0.1"))
+	g.Expect(obj.GetAnnotations()).NotTo(HaveKey(ConfigTemplateAnnotation))
+	g.Expect(obj.GetAnnotations()).NotTo(HaveKey(ConfigChecksumAnnotation))
+}
+
+func TestSecretResolverMissingKey(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "bgp-auth", Namespace: "metallb-system"},
+		Data:       map[string][]byte{"password": []byte("s3cr3t")},
+	}
+	client := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(secret).Build()
+	resolver := &SecretResolver{Client: client, Namespace: "metallb-system"}
+
+	for _, placeholder := range []string{"${secret:bgp-auth/username}", "${secret:other/password}"} {
+		obj := UnstructuredFromYaml(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: metallb-system
+data:
+  config: |
+    address-pools:
+    - name: `+placeholder+`
+      protocol: layer2
+      addresses:
+      - 172.20.0.0/24`)
+		err := resolver.Resolve(context.Background(), obj)
+		g.Expect(err).To(MatchError(ContainSubstring("failed to resolve " + placeholder)))
+	}
+}
@@ -0,0 +1,372 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// DefaultValidity is how long the generated certificates are valid for
+	DefaultValidity = 365 * 24 * time.Hour
+	// DefaultRotateBefore is how long before its expiry the certificate is replaced
+	DefaultRotateBefore = 30 * 24 * time.Hour
+	// DefaultCheckInterval is how often the certificate is checked for rotation
+	DefaultCheckInterval = time.Hour
+)
+
+// +kubebuilder:rbac:groups="",namespace=metallb-system,resources=secrets,verbs=get;list;watch;create;update
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations;validatingwebhookconfigurations,verbs=get;list;update
+
+// Rotator maintains a self-signed serving certificate for the webhook
+// server, for the clusters where cert-manager is not available.
+// The certificate is stored in a Secret so that all the replicas of the
+// operator serve the same one, written to CertDir for the webhook server
+// and injected in the caBundle of the webhooks served by ServiceName.
+type Rotator struct {
+	Client      k8sclient.Client
+	Log         logr.Logger
+	Namespace   string
+	SecretName  string
+	ServiceName string
+	CertDir     string
+
+	// Validity, RotateBefore and CheckInterval default to DefaultValidity,
+	// DefaultRotateBefore and DefaultCheckInterval if not set
+	Validity      time.Duration
+	RotateBefore  time.Duration
+	CheckInterval time.Duration
+
+	// now returns the current time, overridden by the tests
+	now func() time.Time
+}
+
+// Start checks the certificate every CheckInterval until the context is
+// done, rotating it before it expires. It implements manager.Runnable.
+func (r *Rotator) Start(ctx context.Context) error {
+	ticker := time.NewTicker(r.checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.Ensure(ctx); err != nil {
+				r.Log.Error(err, "failed to rotate the webhook certificate")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection returns false as every replica of the operator must
+// write the certificate its webhook server serves.
+func (r *Rotator) NeedLeaderElection() bool {
+	return false
+}
+
+// Ensure generates the certificate if the Secret doesn't hold a valid one or
+// if it is about to expire, then writes it to CertDir and injects it in the
+// caBundle of the webhooks. It must be called once before the webhook server
+// starts, as the server fails to start without a certificate.
+func (r *Rotator) Ensure(ctx context.Context) error {
+	secret, err := r.ensureSecret(ctx)
+	if err != nil {
+		return err
+	}
+	// The certificate is trusted by the webhooks before it is served
+	certPEM := secret.Data[corev1.TLSCertKey]
+	if err := r.injectCABundle(ctx, certPEM); err != nil {
+		return err
+	}
+	return r.writeCertFiles(certPEM, secret.Data[corev1.TLSPrivateKeyKey])
+}
+
+// ensureSecret returns the Secret holding the certificate, creating or
+// updating it when the certificate is missing, invalid or expiring
+func (r *Rotator) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: r.SecretName, Namespace: r.Namespace}, secret)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "failed to get secret %s/%s", r.Namespace, r.SecretName)
+	}
+	found := err == nil
+	if found && !r.needsRotation(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]) {
+		return secret, nil
+	}
+
+	certPEM, keyPEM, err := generateCertificate(r.dnsNames(), r.currentTime(), r.validity())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate the webhook certificate")
+	}
+	if !found {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      r.SecretName,
+				Namespace: r.Namespace,
+			},
+			Type: corev1.SecretTypeTLS,
+		}
+	}
+	secret.Data = map[string][]byte{
+		corev1.TLSCertKey:       certPEM,
+		corev1.TLSPrivateKeyKey: keyPEM,
+	}
+
+	// Another replica of the operator may write the certificate at the same
+	// time, the certificate it wrote being used then
+	if !found {
+		r.Log.Info("creating the webhook certificate", "secret", r.SecretName)
+		err := r.Client.Create(ctx, secret)
+		if apierrors.IsAlreadyExists(err) {
+			return r.getSecret(ctx)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create secret %s/%s", r.Namespace, r.SecretName)
+		}
+		return secret, nil
+	}
+	r.Log.Info("rotating the webhook certificate", "secret", r.SecretName)
+	err = r.Client.Update(ctx, secret)
+	if apierrors.IsConflict(err) {
+		return r.getSecret(ctx)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to update secret %s/%s", r.Namespace, r.SecretName)
+	}
+	return secret, nil
+}
+
+func (r *Rotator) getSecret(ctx context.Context) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: r.SecretName, Namespace: r.Namespace}, secret); err != nil {
+		return nil, errors.Wrapf(err, "failed to get secret %s/%s", r.Namespace, r.SecretName)
+	}
+	return secret, nil
+}
+
+// needsRotation returns true if the certificate and key can't be parsed or
+// don't match, if the certificate isn't valid for the webhook service, or if
+// it expires within RotateBefore
+func (r *Rotator) needsRotation(certPEM, keyPEM []byte) bool {
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return true
+	}
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return true
+	}
+	if err := cert.VerifyHostname(r.dnsNames()[0]); err != nil {
+		return true
+	}
+	return r.currentTime().Add(r.rotateBefore()).After(cert.NotAfter)
+}
+
+// writeCertFiles writes the certificate and key read by the webhook server.
+// The files are only rewritten when they change, the webhook server reloading
+// them on every write.
+func (r *Rotator) writeCertFiles(certPEM, keyPEM []byte) error {
+	if err := os.MkdirAll(r.CertDir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create directory %s", r.CertDir)
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{corev1.TLSPrivateKeyKey, keyPEM},
+		{corev1.TLSCertKey, certPEM},
+	}
+	for _, f := range files {
+		path := filepath.Join(r.CertDir, f.name)
+		if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, f.data) {
+			continue
+		}
+		if err := ioutil.WriteFile(path, f.data, 0600); err != nil {
+			return errors.Wrapf(err, "failed to write %s", path)
+		}
+	}
+	return nil
+}
+
+// injectCABundle adds the certificate to the caBundle of the webhooks served
+// by the webhook service of the operator
+func (r *Rotator) injectCABundle(ctx context.Context, certPEM []byte) error {
+	mutating := &admissionregistrationv1.MutatingWebhookConfigurationList{}
+	if err := r.Client.List(ctx, mutating); err != nil {
+		return errors.Wrapf(err, "failed to list mutatingwebhookconfigurations")
+	}
+	for i := range mutating.Items {
+		config := &mutating.Items[i]
+		changed := false
+		for j := range config.Webhooks {
+			changed = r.setCABundle(&config.Webhooks[j].ClientConfig, certPEM) || changed
+		}
+		if !changed {
+			continue
+		}
+		if err := r.Client.Update(ctx, config); err != nil {
+			return errors.Wrapf(err, "failed to update mutatingwebhookconfiguration %s", config.Name)
+		}
+	}
+
+	validating := &admissionregistrationv1.ValidatingWebhookConfigurationList{}
+	if err := r.Client.List(ctx, validating); err != nil {
+		return errors.Wrapf(err, "failed to list validatingwebhookconfigurations")
+	}
+	for i := range validating.Items {
+		config := &validating.Items[i]
+		changed := false
+		for j := range config.Webhooks {
+			changed = r.setCABundle(&config.Webhooks[j].ClientConfig, certPEM) || changed
+		}
+		if !changed {
+			continue
+		}
+		if err := r.Client.Update(ctx, config); err != nil {
+			return errors.Wrapf(err, "failed to update validatingwebhookconfiguration %s", config.Name)
+		}
+	}
+	return nil
+}
+
+// setCABundle adds the certificate to the caBundle of the webhook if it is
+// served by the webhook service, returning true if it changed
+func (r *Rotator) setCABundle(clientConfig *admissionregistrationv1.WebhookClientConfig, certPEM []byte) bool {
+	service := clientConfig.Service
+	if service == nil || service.Name != r.ServiceName || service.Namespace != r.Namespace {
+		return false
+	}
+	caBundle := r.caBundle(clientConfig.CABundle, certPEM)
+	if bytes.Equal(clientConfig.CABundle, caBundle) {
+		return false
+	}
+	clientConfig.CABundle = caBundle
+	return true
+}
+
+// caBundle returns the certificate followed by the certificates of the current
+// caBundle which are not expired. The previous certificate is kept once rotated,
+// as the other replicas of the operator serve it until their next check.
+func (r *Rotator) caBundle(current, certPEM []byte) []byte {
+	caBundle := append([]byte{}, certPEM...)
+	cert, _ := pem.Decode(certPEM)
+	for rest := current; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" || (cert != nil && bytes.Equal(block.Bytes, cert.Bytes)) {
+			continue
+		}
+		previous, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || !r.currentTime().Before(previous.NotAfter) {
+			continue
+		}
+		caBundle = append(caBundle, pem.EncodeToMemory(block)...)
+	}
+	return caBundle
+}
+
+// dnsNames returns the names the webhook service is reached with,
+// the first one being the one the API server uses
+func (r *Rotator) dnsNames() []string {
+	return []string{
+		fmt.Sprintf("%s.%s.svc", r.ServiceName, r.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", r.ServiceName, r.Namespace),
+		fmt.Sprintf("%s.%s", r.ServiceName, r.Namespace),
+		r.ServiceName,
+	}
+}
+
+func (r *Rotator) currentTime() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+func (r *Rotator) validity() time.Duration {
+	if r.Validity == 0 {
+		return DefaultValidity
+	}
+	return r.Validity
+}
+
+func (r *Rotator) rotateBefore() time.Duration {
+	if r.RotateBefore == 0 {
+		return DefaultRotateBefore
+	}
+	return r.RotateBefore
+}
+
+func (r *Rotator) checkInterval() time.Duration {
+	if r.CheckInterval == 0 {
+		return DefaultCheckInterval
+	}
+	return r.CheckInterval
+}
+
+// generateCertificate returns a self-signed certificate valid for the given
+// names, and its private key, PEM encoded. The certificate is its own CA, so
+// that it can be used as the caBundle of the webhooks.
+func generateCertificate(dnsNames []string, now time.Time, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:              dnsNames,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func parseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
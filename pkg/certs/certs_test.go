@@ -0,0 +1,192 @@
+package certs
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func webhookClientConfig(service string) admissionregistrationv1.WebhookClientConfig {
+	return admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{Name: service, Namespace: "metallb-system"},
+	}
+}
+
+func newRotator(t *testing.T, c client.Client) *Rotator {
+	return &Rotator{
+		Client:      c,
+		Log:         logf.Log,
+		Namespace:   "metallb-system",
+		SecretName:  "webhook-cert",
+		ServiceName: "webhook-service",
+		CertDir:     t.TempDir(),
+	}
+}
+
+func TestEnsure(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	validating := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "validating-webhook-configuration"},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{Name: "vaddresspool.kb.io", ClientConfig: webhookClientConfig("webhook-service")},
+			{Name: "other.example.com", ClientConfig: webhookClientConfig("other-service")},
+		},
+	}
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "mutating-webhook-configuration"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "mservice.metallb.io", ClientConfig: webhookClientConfig("webhook-service")},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(validating, mutating).Build()
+	rotator := newRotator(t, c)
+
+	err := rotator.Ensure(context.Background())
+	g.Expect(err).ToNot(HaveOccurred())
+
+	secret := &corev1.Secret{}
+	err = c.Get(context.Background(), types.NamespacedName{Name: "webhook-cert", Namespace: "metallb-system"}, secret)
+	g.Expect(err).ToNot(HaveOccurred())
+	certPEM := secret.Data[corev1.TLSCertKey]
+	g.Expect(certPEM).ToNot(BeEmpty())
+	g.Expect(secret.Data[corev1.TLSPrivateKeyKey]).ToNot(BeEmpty())
+
+	cert, err := parseCertificate(certPEM)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(cert.DNSNames).To(ContainElement("webhook-service.metallb-system.svc"))
+
+	written, err := ioutil.ReadFile(filepath.Join(rotator.CertDir, corev1.TLSCertKey))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(written).To(Equal(certPEM))
+
+	err = c.Get(context.Background(), types.NamespacedName{Name: validating.Name}, validating)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(validating.Webhooks[0].ClientConfig.CABundle).To(Equal(certPEM))
+	g.Expect(validating.Webhooks[1].ClientConfig.CABundle).To(BeEmpty())
+
+	err = c.Get(context.Background(), types.NamespacedName{Name: mutating.Name}, mutating)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(mutating.Webhooks[0].ClientConfig.CABundle).To(Equal(certPEM))
+
+	// The certificate is kept while it is valid
+	err = rotator.Ensure(context.Background())
+	g.Expect(err).ToNot(HaveOccurred())
+	err = c.Get(context.Background(), types.NamespacedName{Name: "webhook-cert", Namespace: "metallb-system"}, secret)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(secret.Data[corev1.TLSCertKey]).To(Equal(certPEM))
+}
+
+func TestEnsureRotatesExpiringCertificate(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	validating := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "validating-webhook-configuration"},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{Name: "vaddresspool.kb.io", ClientConfig: webhookClientConfig("webhook-service")},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(validating).Build()
+	rotator := newRotator(t, c)
+
+	err := rotator.Ensure(context.Background())
+	g.Expect(err).ToNot(HaveOccurred())
+	secret := &corev1.Secret{}
+	err = c.Get(context.Background(), types.NamespacedName{Name: "webhook-cert", Namespace: "metallb-system"}, secret)
+	g.Expect(err).ToNot(HaveOccurred())
+	oldCert := secret.Data[corev1.TLSCertKey]
+
+	rotator.now = func() time.Time {
+		return time.Now().Add(DefaultValidity - DefaultRotateBefore + time.Hour)
+	}
+	err = rotator.Ensure(context.Background())
+	g.Expect(err).ToNot(HaveOccurred())
+
+	err = c.Get(context.Background(), types.NamespacedName{Name: "webhook-cert", Namespace: "metallb-system"}, secret)
+	g.Expect(err).ToNot(HaveOccurred())
+	newCert := secret.Data[corev1.TLSCertKey]
+	g.Expect(newCert).ToNot(Equal(oldCert))
+
+	// The previous certificate is trusted until it expires, as the other
+	// replicas of the operator still serve it
+	err = c.Get(context.Background(), types.NamespacedName{Name: validating.Name}, validating)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(validating.Webhooks[0].ClientConfig.CABundle).To(Equal(append(append([]byte{}, newCert...), oldCert...)))
+
+	rotator.now = func() time.Time {
+		return time.Now().Add(DefaultValidity + time.Hour)
+	}
+	err = rotator.Ensure(context.Background())
+	g.Expect(err).ToNot(HaveOccurred())
+	err = c.Get(context.Background(), types.NamespacedName{Name: validating.Name}, validating)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(validating.Webhooks[0].ClientConfig.CABundle).To(Equal(newCert))
+}
+
+// racingClient hides the Secret from the first Get, as if another replica
+// of the operator created it in the meantime
+type racingClient struct {
+	client.Client
+	raced bool
+}
+
+func (c *racingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*corev1.Secret); ok && !c.raced {
+		c.raced = true
+		return apierrors.NewNotFound(corev1.Resource("secrets"), key.Name)
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestEnsureConcurrentCreate(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	err := newRotator(t, c).Ensure(context.Background())
+	g.Expect(err).ToNot(HaveOccurred())
+	secret := &corev1.Secret{}
+	err = c.Get(context.Background(), types.NamespacedName{Name: "webhook-cert", Namespace: "metallb-system"}, secret)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// The certificate created by the other replica is served
+	rotator := newRotator(t, &racingClient{Client: c})
+	err = rotator.Ensure(context.Background())
+	g.Expect(err).ToNot(HaveOccurred())
+	written, err := ioutil.ReadFile(filepath.Join(rotator.CertDir, corev1.TLSCertKey))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(written).To(Equal(secret.Data[corev1.TLSCertKey]))
+}
+
+func TestNeedsRotation(t *testing.T) {
+	g := NewGomegaWithT(t)
+	rotator := &Rotator{Namespace: "metallb-system", ServiceName: "webhook-service"}
+	now := time.Now()
+
+	certPEM, keyPEM, err := generateCertificate(rotator.dnsNames(), now, DefaultValidity)
+	g.Expect(err).ToNot(HaveOccurred())
+	otherServiceCert, otherServiceKey, err := generateCertificate([]string{"other.metallb-system.svc"}, now, DefaultValidity)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	g.Expect(rotator.needsRotation(certPEM, keyPEM)).To(BeFalse())
+	g.Expect(rotator.needsRotation(nil, nil)).To(BeTrue())
+	g.Expect(rotator.needsRotation(certPEM, otherServiceKey)).To(BeTrue())
+	g.Expect(rotator.needsRotation(otherServiceCert, otherServiceKey)).To(BeTrue())
+
+	rotator.now = func() time.Time { return now.Add(DefaultValidity - DefaultRotateBefore - time.Hour) }
+	g.Expect(rotator.needsRotation(certPEM, keyPEM)).To(BeFalse())
+	rotator.now = func() time.Time { return now.Add(DefaultValidity - DefaultRotateBefore + time.Hour) }
+	g.Expect(rotator.needsRotation(certPEM, keyPEM)).To(BeTrue())
+}
@@ -0,0 +1,145 @@
+package diagnostics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	metallbv1alpha1 "github.com/metallb/metallb-operator/api/v1alpha1"
+	"github.com/metallb/metallb-operator/pkg/apply"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	configMapName = "config"
+	// ConditionsFile is the bundle entry holding the conditions of the
+	// Metallb and AddressPool objects
+	ConditionsFile = "conditions.yaml"
+)
+
+// CollectDiagnostics returns a snapshot of the state of the operator, suitable
+// for a troubleshooting bundle. The keys of the bundle are file paths named after
+// the objects, e.g. "addresspools/metallb-system/gold.yaml", and the values the
+// YAML representation of the Metallb and AddressPool objects, of the config
+// ConfigMap and of the MetalLB workloads of their namespaces.
+func CollectDiagnostics(ctx context.Context, client k8sclient.Client) (map[string][]byte, error) {
+	bundle := map[string][]byte{}
+	conditions := map[string][]metav1.Condition{}
+	namespaces := map[string]bool{}
+
+	metallbs := &metallbv1alpha1.MetallbList{}
+	if err := client.List(ctx, metallbs); err != nil {
+		return nil, errors.Wrapf(err, "failed to list metallbs")
+	}
+	for i := range metallbs.Items {
+		m := &metallbs.Items[i]
+		if err := add(bundle, "metallbs", m); err != nil {
+			return nil, err
+		}
+		conditions[fmt.Sprintf("Metallb %s/%s", m.Namespace, m.Name)] = m.Status.Conditions
+		namespaces[m.Namespace] = true
+	}
+
+	pools := &metallbv1alpha1.AddressPoolList{}
+	if err := client.List(ctx, pools); err != nil {
+		return nil, errors.Wrapf(err, "failed to list addresspools")
+	}
+	for i := range pools.Items {
+		p := &pools.Items[i]
+		if err := add(bundle, "addresspools", p); err != nil {
+			return nil, err
+		}
+		conditions[fmt.Sprintf("AddressPool %s/%s", p.Namespace, p.Name)] = p.Status.Conditions
+		namespaces[p.Namespace] = true
+	}
+
+	for _, namespace := range sortedKeys(namespaces) {
+		if err := collectNamespace(ctx, client, namespace, bundle); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := yaml.Marshal(conditions)
+	if err != nil {
+		return nil, err
+	}
+	bundle[ConditionsFile] = data
+	return bundle, nil
+}
+
+// collectNamespace adds the config ConfigMap and the MetalLB workloads of the namespace
+func collectNamespace(ctx context.Context, client k8sclient.Client, namespace string, bundle map[string][]byte) error {
+	configMap := &corev1.ConfigMap{}
+	err := client.Get(ctx, types.NamespacedName{Name: configMapName, Namespace: namespace}, configMap)
+	if err != nil && k8sclient.IgnoreNotFound(err) != nil {
+		return errors.Wrapf(err, "failed to get configmap %s/%s", namespace, configMapName)
+	}
+	if err == nil {
+		redactConfig(configMap)
+		if err := add(bundle, "configmaps", configMap); err != nil {
+			return err
+		}
+	}
+
+	workloads := k8sclient.MatchingLabels{"app": "metallb"}
+	deployments := &appsv1.DeploymentList{}
+	if err := client.List(ctx, deployments, k8sclient.InNamespace(namespace), workloads); err != nil {
+		return errors.Wrapf(err, "failed to list deployments in %s", namespace)
+	}
+	for i := range deployments.Items {
+		if err := add(bundle, "deployments", &deployments.Items[i]); err != nil {
+			return err
+		}
+	}
+
+	daemonSets := &appsv1.DaemonSetList{}
+	if err := client.List(ctx, daemonSets, k8sclient.InNamespace(namespace), workloads); err != nil {
+		return errors.Wrapf(err, "failed to list daemonsets in %s", namespace)
+	}
+	for i := range daemonSets.Items {
+		if err := add(bundle, "daemonsets", &daemonSets.Items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactConfig replaces the config of the ConfigMap, holding the values
+// resolved from Secrets, by its template holding their placeholders. The
+// checksum of the resolved config is left out too.
+func redactConfig(configMap *corev1.ConfigMap) {
+	template, ok := configMap.Annotations[apply.ConfigTemplateAnnotation]
+	if !ok || configMap.Data == nil {
+		return
+	}
+	configMap.Data[apply.AddressPoolConfigMap] = template
+	delete(configMap.Annotations, apply.ConfigTemplateAnnotation)
+	delete(configMap.Annotations, apply.ConfigChecksumAnnotation)
+}
+
+// add stores the YAML representation of the object in the bundle,
+// without the managed fields which are only noise for troubleshooting
+func add(bundle map[string][]byte, kind string, obj k8sclient.Object) error {
+	obj.SetManagedFields(nil)
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal %s %s/%s", kind, obj.GetNamespace(), obj.GetName())
+	}
+	bundle[fmt.Sprintf("%s/%s/%s.yaml", kind, obj.GetNamespace(), obj.GetName())] = data
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,102 @@
+package diagnostics
+
+import (
+	"context"
+	"testing"
+
+	metallbv1alpha1 "github.com/metallb/metallb-operator/api/v1alpha1"
+	"github.com/metallb/metallb-operator/pkg/apply"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCollectDiagnostics(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(metallbv1alpha1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(corev1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(appsv1.AddToScheme(scheme)).To(Succeed())
+
+	metallb := &metallbv1alpha1.Metallb{
+		ObjectMeta: metav1.ObjectMeta{Name: "metallb", Namespace: "metallb-system"},
+		Status: metallbv1alpha1.MetallbStatus{
+			Conditions: []metav1.Condition{{Type: "Available", Status: metav1.ConditionTrue, Reason: "Ready"}},
+		},
+	}
+	pool := &metallbv1alpha1.AddressPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "gold", Namespace: "metallb-system"},
+		Spec: metallbv1alpha1.AddressPoolSpec{
+			Name:      "gold",
+			Protocol:  "layer2",
+			Addresses: []string{"172.20.0.0/24"},
+		},
+		Status: metallbv1alpha1.AddressPoolStatus{
+			Conditions: []metav1.Condition{{Type: metallbv1alpha1.ConditionCapacityExceeded, Status: metav1.ConditionTrue, Reason: "NotEnoughAddresses"}},
+		},
+	}
+	config := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "metallb-system"},
+		Data:       map[string]string{"config": "address-pools: []\n"},
+	}
+	controller := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "controller", Namespace: "metallb-system", Labels: map[string]string{"app": "metallb"}},
+	}
+	speaker := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "speaker", Namespace: "metallb-system", Labels: map[string]string{"app": "metallb"}},
+	}
+	unrelated := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "metallb-system"},
+	}
+
+	client := fake.NewFakeClientWithScheme(scheme, metallb, pool, config, controller, speaker, unrelated)
+	bundle, err := CollectDiagnostics(context.Background(), client)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(bundle).To(HaveLen(6))
+	g.Expect(bundle).To(HaveKey("metallbs/metallb-system/metallb.yaml"))
+	g.Expect(string(bundle["addresspools/metallb-system/gold.yaml"])).To(ContainSubstring("172.20.0.0/24"))
+	g.Expect(string(bundle["configmaps/metallb-system/config.yaml"])).To(ContainSubstring("address-pools"))
+	g.Expect(bundle).To(HaveKey("deployments/metallb-system/controller.yaml"))
+	g.Expect(bundle).To(HaveKey("daemonsets/metallb-system/speaker.yaml"))
+	g.Expect(string(bundle[ConditionsFile])).To(ContainSubstring("Metallb metallb-system/metallb"))
+	g.Expect(string(bundle[ConditionsFile])).To(ContainSubstring("AddressPool metallb-system/gold"))
+	g.Expect(string(bundle[ConditionsFile])).To(ContainSubstring("NotEnoughAddresses"))
+}
+
+func TestCollectDiagnosticsRedactsSecrets(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(metallbv1alpha1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(corev1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(appsv1.AddToScheme(scheme)).To(Succeed())
+
+	metallb := &metallbv1alpha1.Metallb{
+		ObjectMeta: metav1.ObjectMeta{Name: "metallb", Namespace: "metallb-system"},
+	}
+	config := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "config",
+			Namespace: "metallb-system",
+			Annotations: map[string]string{
+				apply.ConfigTemplateAnnotation: "peers:\n- peer-address: 10.0.0.1\n  password: ${secret:bgp-auth/password}\n",
+				apply.ConfigChecksumAnnotation: "c0ffee",
+			},
+		},
+		Data: map[string]string{"config": "peers:\n- peer-address: 10.0.0.1\n  password: s3cr3t\n"},
+	}
+
+	client := fake.NewFakeClientWithScheme(scheme, metallb, config)
+	bundle, err := CollectDiagnostics(context.Background(), client)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	data := string(bundle["configmaps/metallb-system/config.yaml"])
+	g.Expect(data).To(ContainSubstring("${secret:bgp-auth/password}"))
+	g.Expect(data).NotTo(ContainSubstring("s3cr3t"))
+	g.Expect(data).NotTo(ContainSubstring(apply.ConfigChecksumAnnotation))
+}
@@ -0,0 +1,88 @@
+package featuregates
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// GrafanaDashboard allows the Metallb resource to create the Grafana dashboard
+	GrafanaDashboard = "GrafanaDashboard"
+	// SecureMetrics allows the Metallb resource to serve the controller metrics
+	// through a kube-rbac-proxy sidecar
+	SecureMetrics = "SecureMetrics"
+	// DefaultAddressPools enables the webhook annotating the services with
+	// the default pool of their namespace
+	DefaultAddressPools = "DefaultAddressPools"
+)
+
+// FeatureGates enables or disables the optional behaviors of the operator
+type FeatureGates struct {
+	GrafanaDashboard    bool
+	SecureMetrics       bool
+	DefaultAddressPools bool
+}
+
+// Defaults returns the feature gates the operator runs with when none is set,
+// all the features being enabled
+func Defaults() FeatureGates {
+	return FeatureGates{
+		GrafanaDashboard:    true,
+		SecureMetrics:       true,
+		DefaultAddressPools: true,
+	}
+}
+
+// Parse returns the default feature gates, overridden by the comma separated
+// list of Name=true|false settings, as in the FEATURE_GATES env variable
+func Parse(value string) (FeatureGates, error) {
+	gates := Defaults()
+	fields := gates.fields()
+	for _, setting := range strings.Split(value, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return FeatureGates{}, fmt.Errorf("invalid feature gate %q, expected Name=true|false", setting)
+		}
+		name := strings.TrimSpace(kv[0])
+		field, ok := fields[name]
+		if !ok {
+			return FeatureGates{}, fmt.Errorf("unknown feature gate %q", name)
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return FeatureGates{}, fmt.Errorf("invalid value of feature gate %q: %v", name, err)
+		}
+		*field = enabled
+	}
+	return gates, nil
+}
+
+// String returns the feature gates in the format accepted by Parse
+func (g FeatureGates) String() string {
+	fields := g.fields()
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	settings := make([]string, 0, len(names))
+	for _, name := range names {
+		settings = append(settings, fmt.Sprintf("%s=%t", name, *fields[name]))
+	}
+	return strings.Join(settings, ",")
+}
+
+func (g *FeatureGates) fields() map[string]*bool {
+	return map[string]*bool{
+		GrafanaDashboard:    &g.GrafanaDashboard,
+		SecureMetrics:       &g.SecureMetrics,
+		DefaultAddressPools: &g.DefaultAddressPools,
+	}
+}
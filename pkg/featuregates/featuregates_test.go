@@ -0,0 +1,27 @@
+package featuregates
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestParse(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	gates, err := Parse("")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(gates).To(Equal(Defaults()))
+
+	gates, err = Parse("SecureMetrics=false, GrafanaDashboard=true")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(gates.SecureMetrics).To(BeFalse())
+	g.Expect(gates.GrafanaDashboard).To(BeTrue())
+	g.Expect(gates.DefaultAddressPools).To(BeTrue())
+	g.Expect(gates.String()).To(Equal("DefaultAddressPools=true,GrafanaDashboard=true,SecureMetrics=false"))
+
+	for _, invalid := range []string{"SecureMetrics", "BGP=true", "SecureMetrics=maybe"} {
+		_, err = Parse(invalid)
+		g.Expect(err).To(HaveOccurred(), invalid)
+	}
+}
@@ -0,0 +1,118 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DefaultTimeout is the timeout of each delivery attempt
+	DefaultTimeout = 5 * time.Second
+	// DefaultRetries is the number of attempts after the first failed one
+	DefaultRetries = 2
+	// DefaultRetryInterval is the delay between two delivery attempts
+	DefaultRetryInterval = time.Second
+)
+
+// Object identifies an object applied by a reconcile
+type Object struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// Summary is the JSON payload describing the outcome of a reconcile
+type Summary struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Changed lists the objects created or updated by the reconcile
+	Changed []Object `json:"changed"`
+	// Conditions are the conditions of the reconciled resource once reconciled
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Error is the error the reconcile failed with, if any
+	Error string `json:"error,omitempty"`
+}
+
+// Notifier posts the summaries of the reconciles to an external webhook.
+// The summaries are delivered in the background, so that a slow or
+// unavailable webhook never blocks nor fails the reconciles.
+type Notifier struct {
+	URL           string
+	Client        *http.Client
+	Log           logr.Logger
+	Retries       int
+	RetryInterval time.Duration
+}
+
+// New returns a Notifier posting to url with the default timeout and retries
+func New(url string, log logr.Logger) *Notifier {
+	return &Notifier{
+		URL:           url,
+		Client:        &http.Client{Timeout: DefaultTimeout},
+		Log:           log,
+		Retries:       DefaultRetries,
+		RetryInterval: DefaultRetryInterval,
+	}
+}
+
+// Notify delivers the summary in the background. It does nothing on a nil
+// Notifier, which is the case when no webhook is configured.
+func (n *Notifier) Notify(summary Summary) {
+	if n == nil {
+		return
+	}
+	go func() {
+		if err := n.send(context.Background(), summary); err != nil {
+			n.Log.Error(err, "failed to notify the reconcile", "url", n.URL, "kind", summary.Kind,
+				"namespace", summary.Namespace, "name", summary.Name)
+		}
+	}()
+}
+
+// send posts the summary, retrying on errors and non 2xx responses
+func (n *Notifier) send(ctx context.Context, summary Summary) error {
+	if summary.Changed == nil {
+		summary.Changed = []Object{}
+	}
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal the reconcile summary")
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = n.post(ctx, body)
+		if err == nil || attempt >= n.Retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(n.RetryInterval):
+		}
+	}
+}
+
+func (n *Notifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestNotify(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	payloads := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.Expect(r.Method).To(Equal(http.MethodPost))
+		g.Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+		body, err := ioutil.ReadAll(r.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+		payload := map[string]interface{}{}
+		g.Expect(json.Unmarshal(body, &payload)).To(Succeed())
+		payloads <- payload
+	}))
+	defer server.Close()
+
+	New(server.URL, logf.Log).Notify(Summary{
+		Kind:      "Metallb",
+		Namespace: "metallb-system",
+		Name:      "metallb",
+		Changed:   []Object{{Kind: "DaemonSet", Namespace: "metallb-system", Name: "speaker"}},
+		Conditions: []metav1.Condition{
+			{Type: "Available", Status: metav1.ConditionTrue, Reason: "Available"},
+		},
+	})
+
+	var payload map[string]interface{}
+	g.Eventually(payloads, 5*time.Second).Should(Receive(&payload))
+	g.Expect(payload).To(HaveKeyWithValue("kind", "Metallb"))
+	g.Expect(payload).To(HaveKeyWithValue("namespace", "metallb-system"))
+	g.Expect(payload).To(HaveKeyWithValue("name", "metallb"))
+	g.Expect(payload).NotTo(HaveKey("error"))
+	g.Expect(payload["changed"]).To(ConsistOf(map[string]interface{}{
+		"kind": "DaemonSet", "namespace": "metallb-system", "name": "speaker",
+	}))
+	g.Expect(payload["conditions"]).To(ConsistOf(
+		HaveKeyWithValue("type", "Available"),
+	))
+}
+
+func TestSendRetries(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	var mu sync.Mutex
+	attempts, failures := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	notifier := New(server.URL, logf.Log)
+	notifier.RetryInterval = time.Millisecond
+
+	failures = 2
+	err := notifier.send(context.Background(), Summary{Kind: "Metallb", Name: "metallb"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(attempts).To(Equal(3))
+
+	// The summary is dropped once the retries are exhausted
+	attempts, failures = 0, 3
+	err = notifier.send(context.Background(), Summary{Kind: "Metallb", Name: "metallb"})
+	g.Expect(err).To(MatchError(ContainSubstring("503")))
+	g.Expect(attempts).To(Equal(3))
+}
@@ -0,0 +1,121 @@
+package pool
+
+import (
+	"bytes"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IPRange is an inclusive range of IP addresses of the same family.
+type IPRange struct {
+	First net.IP
+	Last  net.IP
+}
+
+// Contains returns true if ip belongs to the range.
+func (r IPRange) Contains(ip net.IP) bool {
+	ip = normalize(ip)
+	if ip == nil || len(ip) != len(r.First) {
+		return false
+	}
+	return bytes.Compare(ip, r.First) >= 0 && bytes.Compare(ip, r.Last) <= 0
+}
+
+// Size returns the number of addresses in the range.
+func (r IPRange) Size() *big.Int {
+	first := new(big.Int).SetBytes(r.First)
+	last := new(big.Int).SetBytes(r.Last)
+	size := new(big.Int).Sub(last, first)
+	return size.Add(size, big.NewInt(1))
+}
+
+// Overlaps returns true if the two ranges have addresses in common.
+func (r IPRange) Overlaps(other IPRange) bool {
+	if len(r.First) != len(other.First) {
+		return false
+	}
+	return bytes.Compare(r.First, other.Last) <= 0 && bytes.Compare(other.First, r.Last) <= 0
+}
+
+// Within returns true if all the addresses of the range belong to the subnet.
+func (r IPRange) Within(subnet *net.IPNet) bool {
+	return subnet.Contains(r.First) && subnet.Contains(r.Last)
+}
+
+// IsIPv4 returns true if the range holds IPv4 addresses.
+func (r IPRange) IsIPv4() bool {
+	return len(r.First) == net.IPv4len
+}
+
+// ContainsIP returns true if ip belongs to one of the ranges.
+func ContainsIP(ranges []IPRange, ip net.IP) bool {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRanges parses the addresses of an AddressPool, each of them being
+// either a CIDR prefix or an explicit start-end range of IPs.
+func ParseRanges(addresses []string) ([]IPRange, error) {
+	ranges := make([]IPRange, 0, len(addresses))
+	for _, address := range addresses {
+		r, err := ParseRange(address)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// ParseRange parses a single AddressPool address entry.
+func ParseRange(address string) (IPRange, error) {
+	if strings.Contains(address, "/") {
+		ip, cidr, err := net.ParseCIDR(address)
+		if err != nil {
+			return IPRange{}, errors.Wrapf(err, "invalid CIDR %q", address)
+		}
+		first := normalize(ip.Mask(cidr.Mask))
+		last := make(net.IP, len(first))
+		mask := cidr.Mask[len(cidr.Mask)-len(first):]
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		return IPRange{First: first, Last: last}, nil
+	}
+
+	fs := strings.SplitN(address, "-", 2)
+	if len(fs) != 2 {
+		return IPRange{}, errors.Errorf("invalid IP range %q", address)
+	}
+	first := normalize(net.ParseIP(strings.TrimSpace(fs[0])))
+	if first == nil {
+		return IPRange{}, errors.Errorf("invalid start IP %q in range %q", fs[0], address)
+	}
+	last := normalize(net.ParseIP(strings.TrimSpace(fs[1])))
+	if last == nil {
+		return IPRange{}, errors.Errorf("invalid end IP %q in range %q", fs[1], address)
+	}
+	if len(first) != len(last) {
+		return IPRange{}, errors.Errorf("IP range %q mixes IPv4 and IPv6 addresses", address)
+	}
+	if bytes.Compare(first, last) > 0 {
+		return IPRange{}, errors.Errorf("start IP is after end IP in range %q", address)
+	}
+	return IPRange{First: first, Last: last}, nil
+}
+
+// normalize returns the 4 bytes representation of IPv4 addresses and
+// the 16 bytes representation of IPv6 addresses.
+func normalize(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
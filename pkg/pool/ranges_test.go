@@ -0,0 +1,68 @@
+package pool
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestParseRangeCIDR(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	r, err := ParseRange("192.168.10.0/30")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.First.String()).To(Equal("192.168.10.0"))
+	g.Expect(r.Last.String()).To(Equal("192.168.10.3"))
+	g.Expect(r.Size().Int64()).To(Equal(int64(4)))
+	g.Expect(r.IsIPv4()).To(BeTrue())
+	g.Expect(r.Contains(net.ParseIP("192.168.10.2"))).To(BeTrue())
+	g.Expect(r.Contains(net.ParseIP("192.168.10.4"))).To(BeFalse())
+
+	r, err = ParseRange("fc00:f853:ccd:e799::/124")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.Last.String()).To(Equal("fc00:f853:ccd:e799::f"))
+	g.Expect(r.Size().Int64()).To(Equal(int64(16)))
+	g.Expect(r.IsIPv4()).To(BeFalse())
+	g.Expect(r.Contains(net.ParseIP("192.168.10.2"))).To(BeFalse())
+}
+
+func TestParseRangeStartEnd(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	r, err := ParseRange("172.20.0.100 - 172.20.0.110")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.Size().Int64()).To(Equal(int64(11)))
+	g.Expect(r.Contains(net.ParseIP("172.20.0.110"))).To(BeTrue())
+	g.Expect(r.Contains(net.ParseIP("172.20.0.111"))).To(BeFalse())
+}
+
+func TestParseRangeInvalid(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, address := range []string{
+		"172.20.0.100",
+		"172.20.0.300/24",
+		"172.20.0.110-172.20.0.100",
+		"172.20.0.100-fc00::1",
+	} {
+		_, err := ParseRange(address)
+		g.Expect(err).To(HaveOccurred(), address)
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	parse := func(address string) IPRange {
+		r, err := ParseRange(address)
+		g.Expect(err).NotTo(HaveOccurred())
+		return r
+	}
+
+	g.Expect(parse("172.20.0.0/24").Overlaps(parse("172.20.0.255-172.20.1.10"))).To(BeTrue())
+	g.Expect(parse("172.20.0.0/24").Overlaps(parse("172.20.0.10/32"))).To(BeTrue())
+	g.Expect(parse("172.20.0.0/24").Overlaps(parse("172.20.1.0/24"))).To(BeFalse())
+	g.Expect(parse("172.20.0.0/24").Overlaps(parse("fc00::/64"))).To(BeFalse())
+	g.Expect(parse("fc00::/64").Overlaps(parse("fc00::10-fc00::20"))).To(BeTrue())
+}
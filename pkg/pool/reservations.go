@@ -0,0 +1,116 @@
+package pool
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ExcludeAddresses returns the addresses of a pool without the reserved ones,
+// so that MetalLB doesn't allocate them. The ranges holding a reserved address
+// are split around it, the other ones are returned unchanged. A reserved
+// address not belonging to the pool is an error.
+func ExcludeAddresses(addresses, reserved []string) ([]string, error) {
+	if len(reserved) == 0 {
+		return addresses, nil
+	}
+	ranges, err := ParseRanges(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(reserved))
+	for _, address := range reserved {
+		ip := normalize(net.ParseIP(strings.TrimSpace(address)))
+		if ip == nil {
+			return nil, errors.Errorf("invalid reserved address %q", address)
+		}
+		if !ContainsIP(ranges, ip) {
+			return nil, errors.Errorf("reserved address %s is not part of the addresses of the pool", address)
+		}
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i], ips[j]) < 0
+	})
+
+	res := []string{}
+	for i, r := range ranges {
+		var within []net.IP
+		for _, ip := range ips {
+			if r.Contains(ip) {
+				within = append(within, ip)
+			}
+		}
+		if len(within) == 0 {
+			res = append(res, addresses[i])
+			continue
+		}
+		res = append(res, splitRange(r, within)...)
+	}
+	return res, nil
+}
+
+// splitRange returns the sub-ranges of the range left once the sorted ips,
+// all belonging to it, are removed
+func splitRange(r IPRange, ips []net.IP) []string {
+	res := []string{}
+	first := r.First
+	for _, ip := range ips {
+		if first == nil {
+			break
+		}
+		if c := bytes.Compare(first, ip); c > 0 {
+			// Already excluded
+			continue
+		} else if c < 0 {
+			res = append(res, formatRange(first, prevIP(ip)))
+		}
+		if bytes.Equal(ip, r.Last) {
+			first = nil
+			break
+		}
+		first = nextIP(ip)
+	}
+	if first != nil {
+		res = append(res, formatRange(first, r.Last))
+	}
+	return res
+}
+
+// formatRange returns the MetalLB address of the range, a single address
+// being written as a CIDR prefix
+func formatRange(first, last net.IP) string {
+	if bytes.Equal(first, last) {
+		return fmt.Sprintf("%s/%d", first, len(first)*8)
+	}
+	return fmt.Sprintf("%s-%s", first, last)
+}
+
+func nextIP(ip net.IP) net.IP {
+	res := make(net.IP, len(ip))
+	copy(res, ip)
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i]++
+		if res[i] != 0 {
+			break
+		}
+	}
+	return res
+}
+
+func prevIP(ip net.IP) net.IP {
+	res := make(net.IP, len(ip))
+	copy(res, ip)
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i]--
+		if res[i] != 0xff {
+			break
+		}
+	}
+	return res
+}
@@ -0,0 +1,71 @@
+package pool
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestExcludeAddresses(t *testing.T) {
+	tests := []struct {
+		desc      string
+		addresses []string
+		reserved  []string
+		expected  []string
+	}{
+		{
+			desc:      "no reservation",
+			addresses: []string{"172.20.0.0/24", "fc00:f853:ccd:e799::/124"},
+			expected:  []string{"172.20.0.0/24", "fc00:f853:ccd:e799::/124"},
+		},
+		{
+			desc:      "first and last addresses",
+			addresses: []string{"172.20.0.0/24"},
+			reserved:  []string{"172.20.0.255", "172.20.0.0"},
+			expected:  []string{"172.20.0.1-172.20.0.254"},
+		},
+		{
+			desc:      "address in the middle",
+			addresses: []string{"172.20.0.100-172.20.0.110", "172.20.1.0/24"},
+			reserved:  []string{"172.20.0.105"},
+			expected:  []string{"172.20.0.100-172.20.0.104", "172.20.0.106-172.20.0.110", "172.20.1.0/24"},
+		},
+		{
+			desc:      "single address left",
+			addresses: []string{"172.20.0.100-172.20.0.102"},
+			reserved:  []string{"172.20.0.100", "172.20.0.102", "172.20.0.102"},
+			expected:  []string{"172.20.0.101/32"},
+		},
+		{
+			desc:      "whole range",
+			addresses: []string{"172.20.0.100/31", "172.20.1.0/24"},
+			reserved:  []string{"172.20.0.100", "172.20.0.101"},
+			expected:  []string{"172.20.1.0/24"},
+		},
+		{
+			desc:      "ipv6",
+			addresses: []string{"fc00:f853:ccd:e799::/124"},
+			reserved:  []string{"fc00:f853:ccd:e799::1"},
+			expected:  []string{"fc00:f853:ccd:e799::/128", "fc00:f853:ccd:e799::2-fc00:f853:ccd:e799::f"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			addresses, err := ExcludeAddresses(test.addresses, test.reserved)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(addresses).To(Equal(test.expected))
+		})
+	}
+}
+
+func TestExcludeAddressesInvalid(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	_, err := ExcludeAddresses([]string{"172.20.0.0/24"}, []string{"172.20.1.1"})
+	g.Expect(err).To(MatchError(ContainSubstring("172.20.1.1 is not part of the addresses of the pool")))
+
+	_, err = ExcludeAddresses([]string{"172.20.0.0/24"}, []string{"172.20.0.0/30"})
+	g.Expect(err).To(MatchError(ContainSubstring("invalid reserved address")))
+}
@@ -0,0 +1,57 @@
+package pool
+
+import (
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// NodeSubnetsAnnotation lists, comma separated, the CIDRs of the subnets
+// a node is attached to. It is set by the cluster administrator and used
+// to check the layer2 pools can be announced from the nodes: the addresses
+// in the node status don't carry the prefix length of their subnet, so the
+// check can't be done without it.
+const NodeSubnetsAnnotation = "metallb.io/node-subnets"
+
+// NodeSubnets returns the subnets listed in the annotation of the nodes,
+// ignoring the invalid entries.
+func NodeSubnets(nodes []corev1.Node) []*net.IPNet {
+	res := []*net.IPNet{}
+	for _, node := range nodes {
+		value, ok := node.Annotations[NodeSubnetsAnnotation]
+		if !ok {
+			continue
+		}
+		for _, cidr := range strings.Split(value, ",") {
+			_, subnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				continue
+			}
+			res = append(res, subnet)
+		}
+	}
+	return res
+}
+
+// OutsideSubnets returns the ranges not belonging to any of the subnets.
+// As this is best effort, nothing is returned when no subnet is known.
+func OutsideSubnets(ranges []IPRange, subnets []*net.IPNet) []IPRange {
+	if len(subnets) == 0 {
+		return nil
+	}
+	res := []IPRange{}
+	for _, r := range ranges {
+		within := false
+		for _, subnet := range subnets {
+			if r.Within(subnet) {
+				within = true
+				break
+			}
+		}
+		if !within {
+			res = append(res, r)
+		}
+	}
+	return res
+}
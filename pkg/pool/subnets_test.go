@@ -0,0 +1,30 @@
+package pool
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOutsideSubnets(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	nodes := []corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{NodeSubnetsAnnotation: "172.18.0.0/16, fc00:f853:ccd:e793::/64"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2", Annotations: map[string]string{NodeSubnetsAnnotation: "10.10.0.0/24,invalid"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node3"}},
+	}
+	subnets := NodeSubnets(nodes)
+	g.Expect(subnets).To(HaveLen(3))
+
+	ranges, err := ParseRanges([]string{"172.18.0.100-172.18.0.255", "10.10.1.0/28", "fc00:f853:ccd:e793::10/124"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	outside := OutsideSubnets(ranges, subnets)
+	g.Expect(outside).To(HaveLen(1))
+	g.Expect(outside[0].First.String()).To(Equal("10.10.1.0"))
+
+	g.Expect(OutsideSubnets(ranges, NodeSubnets(nodes[2:]))).To(BeEmpty())
+}
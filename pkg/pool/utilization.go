@@ -0,0 +1,167 @@
+package pool
+
+import (
+	"math/big"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// AddressPoolAnnotation is the annotation used by a service to request
+// its address from a specific pool.
+const AddressPoolAnnotation = "metallb.universe.tf/address-pool"
+
+// SharedIPAnnotation is the annotation holding the sharing key of the
+// services allowed to share their address with each other.
+const SharedIPAnnotation = "metallb.universe.tf/allow-shared-ip"
+
+// Allocation is an address of a pool assigned to a LoadBalancer service.
+type Allocation struct {
+	IP      net.IP
+	Service types.NamespacedName
+}
+
+// Allocations returns the addresses within the given ranges which are
+// assigned to the LoadBalancer services.
+func Allocations(ranges []IPRange, services []corev1.Service) []Allocation {
+	res := []Allocation{}
+	for _, svc := range services {
+		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			ip := net.ParseIP(ingress.IP)
+			if ip == nil {
+				continue
+			}
+			if ContainsIP(ranges, ip) {
+				res = append(res, Allocation{
+					IP:      ip,
+					Service: types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name},
+				})
+			}
+		}
+	}
+	return res
+}
+
+// AllocatedAddresses returns the number of distinct addresses in use,
+// as services sharing an IP draw only one address from the pool.
+func AllocatedAddresses(allocations []Allocation) int {
+	ips := map[string]bool{}
+	for _, a := range allocations {
+		ips[a.IP.String()] = true
+	}
+	return len(ips)
+}
+
+// Capacity returns the number of addresses in the ranges.
+func Capacity(ranges []IPRange) *big.Int {
+	capacity := big.NewInt(0)
+	for _, r := range ranges {
+		capacity.Add(capacity, r.Size())
+	}
+	return capacity
+}
+
+// RequestedAddresses returns the number of addresses requested from the pool
+// with the given name: the ones already allocated, plus one for each
+// LoadBalancer service still waiting for an address from the pool.
+func RequestedAddresses(name string, ranges []IPRange, services []corev1.Service) int {
+	requested := AllocatedAddresses(Allocations(ranges, services))
+	for _, svc := range services {
+		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || len(svc.Status.LoadBalancer.Ingress) > 0 {
+			continue
+		}
+		if svc.Annotations[AddressPoolAnnotation] == name {
+			requested++
+		}
+	}
+	return requested
+}
+
+// IsUnused returns true if no LoadBalancer service has an address of the
+// ranges, nor requests an address from the pool with the given name.
+func IsUnused(name string, ranges []IPRange, services []corev1.Service) bool {
+	if len(Allocations(ranges, services)) > 0 {
+		return false
+	}
+	for _, svc := range services {
+		if svc.Spec.Type == corev1.ServiceTypeLoadBalancer && svc.Annotations[AddressPoolAnnotation] == name {
+			return false
+		}
+	}
+	return true
+}
+
+// IsDualStack returns true if the service requires an address of each
+// IP family.
+func IsDualStack(svc corev1.Service) bool {
+	if svc.Spec.IPFamilyPolicy != nil && *svc.Spec.IPFamilyPolicy == corev1.IPFamilyPolicyRequireDualStack {
+		return true
+	}
+	return len(svc.Spec.IPFamilies) == 2
+}
+
+// HasBothFamilies returns true if the ranges hold both IPv4 and IPv6 addresses.
+func HasBothFamilies(ranges []IPRange) bool {
+	ipv4, ipv6 := false, false
+	for _, r := range ranges {
+		if r.IsIPv4() {
+			ipv4 = true
+		} else {
+			ipv6 = true
+		}
+	}
+	return ipv4 && ipv6
+}
+
+// DualStackConflicts returns the dual-stack LoadBalancer services requesting
+// their addresses from the pool with the given name, while the ranges of the
+// pool do not hold both IP families.
+func DualStackConflicts(name string, ranges []IPRange, services []corev1.Service) []types.NamespacedName {
+	if HasBothFamilies(ranges) {
+		return nil
+	}
+	res := []types.NamespacedName{}
+	for _, svc := range services {
+		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || svc.Annotations[AddressPoolAnnotation] != name {
+			continue
+		}
+		if IsDualStack(svc) {
+			res = append(res, types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name})
+		}
+	}
+	return res
+}
+
+// SharingConflicts returns the LoadBalancer services requesting their address
+// from the pool with the given name while sharing it with a service requesting
+// another pool. As the pool is excluded from the automatic assignment, such
+// services can't obtain an address both of them may use.
+func SharingConflicts(name string, services []corev1.Service) []types.NamespacedName {
+	pools := map[string]map[string]bool{}
+	for _, svc := range services {
+		key := svc.Annotations[SharedIPAnnotation]
+		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || key == "" {
+			continue
+		}
+		if pools[key] == nil {
+			pools[key] = map[string]bool{}
+		}
+		pools[key][svc.Annotations[AddressPoolAnnotation]] = true
+	}
+
+	res := []types.NamespacedName{}
+	for _, svc := range services {
+		key := svc.Annotations[SharedIPAnnotation]
+		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || key == "" || svc.Annotations[AddressPoolAnnotation] != name {
+			continue
+		}
+		if len(pools[key]) > 1 {
+			res = append(res, types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name})
+		}
+	}
+	return res
+}
@@ -0,0 +1,136 @@
+package pool
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func loadBalancer(name string, ips ...string) corev1.Service {
+	svc := corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	}
+	for _, ip := range ips {
+		svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: ip})
+	}
+	return svc
+}
+
+func TestAllocations(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ranges, err := ParseRanges([]string{"172.20.0.0/24"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	clusterIP := loadBalancer("clusterip", "172.20.0.5")
+	clusterIP.Spec.Type = corev1.ServiceTypeClusterIP
+
+	services := []corev1.Service{
+		loadBalancer("svc1", "172.20.0.1"),
+		loadBalancer("svc2", "172.20.0.1"),
+		loadBalancer("svc3", "172.20.0.2"),
+		loadBalancer("other", "172.30.0.1"),
+		loadBalancer("pending"),
+		clusterIP,
+	}
+
+	allocations := Allocations(ranges, services)
+	g.Expect(allocations).To(HaveLen(3))
+	g.Expect(allocations[2].Service).To(Equal(types.NamespacedName{Namespace: "default", Name: "svc3"}))
+	g.Expect(AllocatedAddresses(allocations)).To(Equal(2))
+}
+
+func TestRequestedAddresses(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ranges, err := ParseRanges([]string{"172.20.0.1/32", "172.20.0.10-172.20.0.11"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(Capacity(ranges).Int64()).To(Equal(int64(3)))
+
+	pending := loadBalancer("pending")
+	pending.Annotations = map[string]string{AddressPoolAnnotation: "tiny"}
+	otherPool := loadBalancer("other-pool")
+	otherPool.Annotations = map[string]string{AddressPoolAnnotation: "other"}
+
+	services := []corev1.Service{
+		loadBalancer("svc1", "172.20.0.1"),
+		loadBalancer("svc2", "172.20.0.10"),
+		pending,
+		otherPool,
+		loadBalancer("no-pool"),
+	}
+	g.Expect(RequestedAddresses("tiny", ranges, services)).To(Equal(3))
+
+	pending2 := pending.DeepCopy()
+	pending2.Name = "pending2"
+	services = append(services, *pending2)
+	g.Expect(RequestedAddresses("tiny", ranges, services)).To(Equal(4))
+}
+
+func TestIsUnused(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ranges, err := ParseRanges([]string{"172.20.0.0/24"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	services := []corev1.Service{loadBalancer("other", "172.30.0.1")}
+	g.Expect(IsUnused("explicit", ranges, services)).To(BeTrue())
+
+	pending := loadBalancer("pending")
+	pending.Annotations = map[string]string{AddressPoolAnnotation: "explicit"}
+	g.Expect(IsUnused("explicit", ranges, append(services, pending))).To(BeFalse())
+
+	g.Expect(IsUnused("explicit", ranges, append(services, loadBalancer("svc", "172.20.0.1")))).To(BeFalse())
+}
+
+func TestDualStackConflicts(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	v4Only, err := ParseRanges([]string{"172.20.0.0/24"})
+	g.Expect(err).NotTo(HaveOccurred())
+	dualStack, err := ParseRanges([]string{"172.20.0.0/24", "fc00:f853:ccd:e799::/124"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	requireDualStack := corev1.IPFamilyPolicyRequireDualStack
+	web := loadBalancer("web")
+	web.Annotations = map[string]string{AddressPoolAnnotation: "gold"}
+	web.Spec.IPFamilyPolicy = &requireDualStack
+	preferred := loadBalancer("preferred")
+	preferred.Annotations = map[string]string{AddressPoolAnnotation: "gold"}
+	preferred.Spec.IPFamilies = []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}
+	singleStack := loadBalancer("single")
+	singleStack.Annotations = map[string]string{AddressPoolAnnotation: "gold"}
+	otherPool := web.DeepCopy()
+	otherPool.Name = "other-pool"
+	otherPool.Annotations[AddressPoolAnnotation] = "silver"
+
+	services := []corev1.Service{web, preferred, singleStack, *otherPool}
+	g.Expect(DualStackConflicts("gold", v4Only, services)).To(Equal([]types.NamespacedName{
+		{Namespace: "default", Name: "web"},
+		{Namespace: "default", Name: "preferred"},
+	}))
+	g.Expect(DualStackConflicts("gold", dualStack, services)).To(BeEmpty())
+}
+
+func TestSharingConflicts(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	web := loadBalancer("web")
+	web.Annotations = map[string]string{AddressPoolAnnotation: "explicit", SharedIPAnnotation: "frontend"}
+	api := loadBalancer("api")
+	api.Annotations = map[string]string{AddressPoolAnnotation: "explicit", SharedIPAnnotation: "frontend"}
+	g.Expect(SharingConflicts("explicit", []corev1.Service{web, api})).To(BeEmpty())
+
+	autoAssigned := loadBalancer("auto-assigned")
+	autoAssigned.Annotations = map[string]string{SharedIPAnnotation: "frontend"}
+	otherKey := loadBalancer("other-key")
+	otherKey.Annotations = map[string]string{AddressPoolAnnotation: "explicit", SharedIPAnnotation: "backend"}
+	g.Expect(SharingConflicts("explicit", []corev1.Service{web, api, autoAssigned, otherKey})).To(Equal([]types.NamespacedName{
+		{Namespace: "default", Name: "web"},
+		{Namespace: "default", Name: "api"},
+	}))
+}
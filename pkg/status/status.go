@@ -94,23 +94,55 @@ func getBaseConditions() []metav1.Condition {
 	}
 }
 
-func IsMetallbAvailable(ctx context.Context, client k8sclient.Client, namespace string) error {
+// IsMetallbAvailable returns a MetallbResourcesNotReadyError when the MetalLB
+// workloads of the namespace are not available yet. With waitForReadiness,
+// they are only available once the pods of their current spec are all ready.
+func IsMetallbAvailable(ctx context.Context, client k8sclient.Client, namespace string, speakerWorkloadType string, waitForReadiness bool) error {
 
-	ds := &appsv1.DaemonSet{}
-	err := client.Get(ctx, types.NamespacedName{Name: "speaker", Namespace: namespace}, ds)
-	if err != nil {
-		return err
-	}
-	if ds.Status.DesiredNumberScheduled != ds.Status.CurrentNumberScheduled {
-		return MetallbResourcesNotReadyError{Message: "Metallb speaker daemonset not ready"}
+	if speakerWorkloadType == metallbv1alpha1.SpeakerWorkloadDeployment {
+		speaker := &appsv1.Deployment{}
+		err := client.Get(ctx, types.NamespacedName{Name: "speaker", Namespace: namespace}, speaker)
+		if err != nil {
+			return err
+		}
+		if speaker.Status.ReadyReplicas != *speaker.Spec.Replicas || (waitForReadiness && !isDeploymentReady(speaker)) {
+			return MetallbResourcesNotReadyError{Message: "Metallb speaker deployment not ready"}
+		}
+	} else {
+		ds := &appsv1.DaemonSet{}
+		err := client.Get(ctx, types.NamespacedName{Name: "speaker", Namespace: namespace}, ds)
+		if err != nil {
+			return err
+		}
+		if ds.Status.DesiredNumberScheduled != ds.Status.CurrentNumberScheduled || (waitForReadiness && !isDaemonSetReady(ds)) {
+			return MetallbResourcesNotReadyError{Message: "Metallb speaker daemonset not ready"}
+		}
 	}
 	deployment := &appsv1.Deployment{}
-	err = client.Get(ctx, types.NamespacedName{Name: "controller", Namespace: namespace}, deployment)
+	err := client.Get(ctx, types.NamespacedName{Name: "controller", Namespace: namespace}, deployment)
 	if err != nil {
 		return err
 	}
-	if deployment.Status.ReadyReplicas != *deployment.Spec.Replicas {
+	if deployment.Status.ReadyReplicas != *deployment.Spec.Replicas || (waitForReadiness && !isDeploymentReady(deployment)) {
 		return MetallbResourcesNotReadyError{Message: "Metallb controller deployment not ready"}
 	}
 	return nil
 }
+
+// isDeploymentReady returns true when the deployment controller observed the
+// current spec, and all the replicas run it and are ready
+func isDeploymentReady(deployment *appsv1.Deployment) bool {
+	replicas := *deployment.Spec.Replicas
+	return deployment.Status.ObservedGeneration >= deployment.Generation &&
+		deployment.Status.UpdatedReplicas == replicas &&
+		deployment.Status.ReadyReplicas == replicas
+}
+
+// isDaemonSetReady returns true when the daemonset controller observed the
+// current spec, and the pods scheduled on all the nodes run it and are ready
+func isDaemonSetReady(ds *appsv1.DaemonSet) bool {
+	desired := ds.Status.DesiredNumberScheduled
+	return ds.Status.ObservedGeneration >= ds.Generation &&
+		ds.Status.UpdatedNumberScheduled == desired &&
+		ds.Status.NumberReady == desired
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -49,3 +50,31 @@ func validateConditionTypes(g *GomegaWithT, conditions []metav1.Condition) {
 	g.Expect(conditions[2].Type).To(Equal(ConditionProgressing))
 	g.Expect(conditions[3].Type).To(Equal(ConditionDegraded))
 }
+
+func TestIsDeploymentReady(t *testing.T) {
+	g := NewGomegaWithT(t)
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Generation: 2},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status:     appsv1.DeploymentStatus{ObservedGeneration: 1, UpdatedReplicas: 1, ReadyReplicas: 1},
+	}
+	g.Expect(isDeploymentReady(deployment)).To(BeFalse())
+
+	deployment.Status.ObservedGeneration = 2
+	g.Expect(isDeploymentReady(deployment)).To(BeTrue())
+
+	deployment.Status.UpdatedReplicas = 0
+	g.Expect(isDeploymentReady(deployment)).To(BeFalse())
+}
+
+func TestIsDaemonSetReady(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ds := &appsv1.DaemonSet{
+		Status: appsv1.DaemonSetStatus{DesiredNumberScheduled: 2, CurrentNumberScheduled: 2, UpdatedNumberScheduled: 2, NumberReady: 1},
+	}
+	g.Expect(isDaemonSetReady(ds)).To(BeFalse())
+
+	ds.Status.NumberReady = 2
+	g.Expect(isDaemonSetReady(ds)).To(BeTrue())
+}
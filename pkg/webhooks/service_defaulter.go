@@ -0,0 +1,102 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	metallbv1alpha1 "github.com/metallb/metallb-operator/api/v1alpha1"
+	"github.com/metallb/metallb-operator/pkg/pool"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// ServiceDefaulterPath is the path the service defaulting webhook is served on
+const ServiceDefaulterPath = "/mutate-v1-service"
+
+const metallbName = "metallb"
+
+// +kubebuilder:webhook:verbs=create;update,path=/mutate-v1-service,mutating=true,failurePolicy=ignore,groups="",resources=services,versions=v1,name=mservice.metallb.io
+
+// ServiceDefaulter annotates the LoadBalancer services requesting no specific
+// pool with the default pool of their namespace, as configured by the
+// defaultAddressPools field of the Metallb resource
+type ServiceDefaulter struct {
+	// Client reads the Metallb resource of the operator namespace
+	Client client.Reader
+	// Namespace is the namespace of the Metallb resource
+	Namespace string
+	decoder   *admission.Decoder
+}
+
+var _ admission.Handler = &ServiceDefaulter{}
+var _ admission.DecoderInjector = &ServiceDefaulter{}
+
+// Handle implements admission.Handler
+func (d *ServiceDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	svc := &corev1.Service{}
+	if err := d.decoder.Decode(req, svc); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	metallb := &metallbv1alpha1.Metallb{}
+	err := d.Client.Get(ctx, types.NamespacedName{Name: metallbName, Namespace: d.Namespace}, metallb)
+	if apierrors.IsNotFound(err) {
+		return admission.Allowed("no Metallb resource")
+	}
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	if !SetDefaultPool(svc, req.Namespace, metallb.Spec.DefaultAddressPools) {
+		return admission.Allowed("")
+	}
+	marshaled, err := json.Marshal(svc)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// InjectDecoder implements admission.DecoderInjector
+func (d *ServiceDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+// ServiceAllower admits all the services unchanged. It is served on
+// ServiceDefaulterPath instead of the ServiceDefaulter when the
+// DefaultAddressPools feature gate is disabled, as the deployed mutating
+// webhook still sends the services to the operator.
+type ServiceAllower struct{}
+
+var _ admission.Handler = ServiceAllower{}
+
+// Handle implements admission.Handler
+func (ServiceAllower) Handle(ctx context.Context, req admission.Request) admission.Response {
+	return admission.Allowed("the DefaultAddressPools feature gate is disabled")
+}
+
+// SetDefaultPool sets the address pool annotation of a LoadBalancer service
+// of the namespace to the default pool of the namespace, unless the service
+// already requests a pool. It returns true if the service was annotated.
+func SetDefaultPool(svc *corev1.Service, namespace string, defaultPools map[string]string) bool {
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return false
+	}
+	if _, ok := svc.Annotations[pool.AddressPoolAnnotation]; ok {
+		return false
+	}
+	defaultPool, ok := defaultPools[namespace]
+	if !ok || defaultPool == "" {
+		return false
+	}
+	if svc.Annotations == nil {
+		svc.Annotations = map[string]string{}
+	}
+	svc.Annotations[pool.AddressPoolAnnotation] = defaultPool
+	return true
+}
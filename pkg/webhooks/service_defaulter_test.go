@@ -0,0 +1,144 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	metallbv1alpha1 "github.com/metallb/metallb-operator/api/v1alpha1"
+	"github.com/metallb/metallb-operator/pkg/pool"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestSetDefaultPool(t *testing.T) {
+	defaultPools := map[string]string{"shop": "gold"}
+
+	tests := []struct {
+		desc        string
+		namespace   string
+		serviceType corev1.ServiceType
+		annotations map[string]string
+		mutated     bool
+		expected    map[string]string
+	}{
+		{
+			desc:        "without annotation",
+			namespace:   "shop",
+			serviceType: corev1.ServiceTypeLoadBalancer,
+			mutated:     true,
+			expected:    map[string]string{pool.AddressPoolAnnotation: "gold"},
+		},
+		{
+			desc:        "keeps the other annotations",
+			namespace:   "shop",
+			serviceType: corev1.ServiceTypeLoadBalancer,
+			annotations: map[string]string{pool.SharedIPAnnotation: "frontend"},
+			mutated:     true,
+			expected:    map[string]string{pool.SharedIPAnnotation: "frontend", pool.AddressPoolAnnotation: "gold"},
+		},
+		{
+			desc:        "with a pool requested",
+			namespace:   "shop",
+			serviceType: corev1.ServiceTypeLoadBalancer,
+			annotations: map[string]string{pool.AddressPoolAnnotation: "silver"},
+			expected:    map[string]string{pool.AddressPoolAnnotation: "silver"},
+		},
+		{
+			desc:        "namespace without default",
+			namespace:   "default",
+			serviceType: corev1.ServiceTypeLoadBalancer,
+		},
+		{
+			desc:        "not a LoadBalancer",
+			namespace:   "shop",
+			serviceType: corev1.ServiceTypeClusterIP,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: test.namespace, Annotations: test.annotations},
+				Spec:       corev1.ServiceSpec{Type: test.serviceType},
+			}
+			g.Expect(SetDefaultPool(svc, test.namespace, defaultPools)).To(Equal(test.mutated))
+			if test.expected == nil {
+				g.Expect(svc.Annotations).To(BeEmpty())
+			} else {
+				g.Expect(svc.Annotations).To(Equal(test.expected))
+			}
+		})
+	}
+}
+
+func TestServiceDefaulterHandle(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(metallbv1alpha1.AddToScheme(scheme)).To(Succeed())
+	metallb := &metallbv1alpha1.Metallb{
+		ObjectMeta: metav1.ObjectMeta{Name: "metallb", Namespace: "metallb-system"},
+		Spec: metallbv1alpha1.MetallbSpec{
+			DefaultAddressPools: map[string]string{"shop": "gold"},
+		},
+	}
+	defaulter := &ServiceDefaulter{
+		Client:    fake.NewFakeClientWithScheme(scheme, metallb),
+		Namespace: "metallb-system",
+	}
+	decoder, err := admission.NewDecoder(scheme)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(defaulter.InjectDecoder(decoder)).To(Succeed())
+
+	request := func(svc *corev1.Service) admission.Request {
+		raw, err := json.Marshal(svc)
+		g.Expect(err).NotTo(HaveOccurred())
+		return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: svc.Namespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		}}
+	}
+
+	svc := &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	}
+	response := defaulter.Handle(context.Background(), request(svc))
+	g.Expect(response.Allowed).To(BeTrue())
+	g.Expect(response.Patches).To(HaveLen(1))
+	g.Expect(response.Patches[0].Path).To(Equal("/metadata/annotations"))
+	g.Expect(response.Patches[0].Value).To(Equal(map[string]interface{}{pool.AddressPoolAnnotation: "gold"}))
+
+	svc.Annotations = map[string]string{pool.AddressPoolAnnotation: "silver"}
+	response = defaulter.Handle(context.Background(), request(svc))
+	g.Expect(response.Allowed).To(BeTrue())
+	g.Expect(response.Patches).To(BeEmpty())
+}
+
+func TestServiceAllowerHandle(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	raw, err := json.Marshal(&corev1.Service{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	response := ServiceAllower{}.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Namespace: "shop",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	g.Expect(response.Allowed).To(BeTrue())
+	g.Expect(response.Patches).To(BeEmpty())
+}